@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// blockPrivateAddresses controls whether server addresses in private, loopback
+// and link-local ranges are refused, so that a public instance can't be used
+// to probe the network it runs on.
+// It can be turned on by setting the BLOCK_PRIVATE_ADDRESSES environment variable to "1".
+var blockPrivateAddresses bool
+
+// allowedNetworks are the only networks that server addresses may be in, or nil to allow any network.
+// Addresses in them are allowed even if they are private.
+// It can be set to a comma separated list of CIDRs or IPs using the ALLOWED_NETWORKS environment variable.
+var allowedNetworks []*net.IPNet
+
+// parseNetworks parses a comma separated list of CIDRs or IP addresses, treating an IP address as a network of one address.
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if ip := net.ParseIP(item); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR or an IP address", item)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isPrivateIP returns true if an IP address isn't publicly routable:
+// loopback, private (RFC 1918 and RFC 4193), link-local, multicast or unspecified addresses.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// checkAddress returns a ReportError with the code ADDRESS_BLOCKED if an "<ip>:<port>" address
+// may not be connected to because of allowedNetworks or blockPrivateAddresses, or nil if it may.
+func checkAddress(addr string) error {
+	if !blockPrivateAddresses && allowedNetworks == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ReportError{Code: codeAddressBlocked, Message: fmt.Sprintf("Not connecting to %s since it isn't an IP address", addr)}
+	}
+	if allowedNetworks != nil {
+		for _, network := range allowedNetworks {
+			if network.Contains(ip) {
+				return nil
+			}
+		}
+		return ReportError{Code: codeAddressBlocked, Message: fmt.Sprintf("Not connecting to %s since it isn't in the networks this tester is allowed to connect to", addr)}
+	}
+	if isPrivateIP(ip) {
+		return ReportError{Code: codeAddressBlocked, Message: fmt.Sprintf("Not connecting to %s since it is a private, loopback or link-local address", addr)}
+	}
+	return nil
+}
+
+// checkDialAddress is a net.Dialer Control function that refuses to connect to addresses blocked by checkAddress.
+// The dialer calls it with the resolved address, so it also covers redirects and names that resolve to blocked addresses.
+func checkDialAddress(network, address string, conn syscall.RawConn) error {
+	return checkAddress(address)
+}
+
+// restrictedTransport returns a HTTP transport like the default one that refuses to connect to addresses blocked by checkAddress.
+func restrictedTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: checkDialAddress}
+	transport.DialContext = dialer.DialContext
+	return transport
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The maximum number of issuer certificates fetched using the Authority Information Access extension for a chain.
+const maxAIAFetches = 3
+
+// The maximum number of bytes of an issuer certificate that we will read.
+const maxAIABytes = 64 * 1024
+
+// aiaClient is the HTTP client used to fetch issuer certificates.
+// Its transport refuses to connect to addresses blocked by checkAddress. The issuer
+// URLs come from the certificates served by the server being tested, so unless
+// BLOCK_PRIVATE_ADDRESSES or ALLOWED_NETWORKS is set they can make the tester send
+// GET requests to its own network, although the responses are never reported.
+// Redirects aren't followed, so a request never leaves the issuer URL.
+var aiaClient = &http.Client{
+	Timeout:       10 * time.Second,
+	Transport:     restrictedTransport(),
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// isIncompleteChain returns true if a chain failed to verify because the
+// server didn't send the intermediate certificates needed to reach a trusted root.
+// The chain has already been verified with only the certificates served, so if that
+// failed with an unknown authority it is verified again with the missing issuers
+// fetched using the Authority Information Access extension, and the chain is only
+// incomplete if that succeeds. A chain that ends at an untrusted certificate fails both times.
+// Browsers fetch missing intermediates the same way, so they accept these chains, but matrix servers don't.
+// The context should have the deadline of the probe of the address so that fetching doesn't add to it.
+func isIncompleteChain(ctx context.Context, certs []*x509.Certificate, chainErr error, now time.Time) bool {
+	var authorityErr x509.UnknownAuthorityError
+	if len(certs) == 0 || !errors.As(chainErr, &authorityErr) {
+		return false
+	}
+	issuers := fetchAIAIssuers(ctx, certs[len(certs)-1])
+	if len(issuers) == 0 {
+		return false
+	}
+	completed := append(append([]*x509.Certificate{}, certs...), issuers...)
+	return verifyChain(completed, now) == nil
+}
+
+// fetchAIAIssuers follows the http issuer URLs in the Authority Information Access extension
+// from a certificate, up to maxAIAFetches times or until a self-signed certificate.
+// Returns the issuers fetched, stopping at the first that couldn't be fetched.
+func fetchAIAIssuers(ctx context.Context, cert *x509.Certificate) []*x509.Certificate {
+	var issuers []*x509.Certificate
+	for i := 0; i < maxAIAFetches && !isSelfSigned(cert); i++ {
+		url := aiaIssuerURL(cert)
+		if url == "" {
+			break
+		}
+		issuer, err := fetchAIAIssuer(ctx, url)
+		if err != nil {
+			break
+		}
+		issuers = append(issuers, issuer)
+		cert = issuer
+	}
+	return issuers
+}
+
+// aiaIssuerURL returns the first http issuer URL of a certificate, or empty if it has none.
+// CAs publish issuers over plain http, as RFC 5280 requires, so other schemes are never fetched.
+func aiaIssuerURL(cert *x509.Certificate) string {
+	for _, url := range cert.IssuingCertificateURL {
+		if strings.HasPrefix(strings.ToLower(url), "http://") {
+			return url
+		}
+	}
+	return ""
+}
+
+// fetchAIAIssuer fetches a DER or PEM encoded certificate from an issuer URL.
+func fetchAIAIssuer(ctx context.Context, url string) (*x509.Certificate, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", userAgent)
+	response, err := aiaClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s returned %q", url, response.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxAIABytes))
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(body); block != nil {
+		body = block.Bytes
+	}
+	return x509.ParseCertificate(body)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// createAIATestCert creates a certificate signed by parent, or self-signed if parent is nil.
+// The certificate is a CA unless it is for matrix.example.com.
+func createAIATestCert(t *testing.T, name string, parent *x509.Certificate, parentKey crypto.Signer, issuerURL string) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		IsCA:                  name != "matrix.example.com",
+		BasicConstraintsValid: true,
+	}
+	if template.IsCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.DNSNames = []string{name}
+	}
+	if issuerURL != "" {
+		template.IssuingCertificateURL = []string{issuerURL}
+	}
+	if parent == nil {
+		parent, parentKey = &template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// serveAIATestCert serves the DER encoding of a certificate, returning its URL.
+func serveAIATestCert(t *testing.T, cert *x509.Certificate) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(cert.Raw)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func testIncompleteChain(t *testing.T, certs []*x509.Certificate, want bool) {
+	now := time.Now()
+	chainErr := verifyChain(certs, now)
+	if got := isIncompleteChain(context.Background(), certs, chainErr, now); got != want {
+		t.Errorf("isIncompleteChain(%v): want %v got %v", chainErr, want, got)
+	}
+}
+
+func TestIncompleteChainMissingIntermediate(t *testing.T) {
+	root, rootKey := createAIATestCert(t, "Test Root", nil, nil, "")
+	caBundleRoots = x509.NewCertPool()
+	caBundleRoots.AddCert(root)
+	defer func() { caBundleRoots = nil }()
+	intermediate, intermediateKey := createAIATestCert(t, "Test Intermediate", root, rootKey, "")
+	leaf, _ := createAIATestCert(t, "matrix.example.com", intermediate, intermediateKey, serveAIATestCert(t, intermediate))
+
+	testIncompleteChain(t, []*x509.Certificate{leaf}, true)
+	testIncompleteChain(t, []*x509.Certificate{leaf, intermediate}, false)
+}
+
+func TestIncompleteChainUntrustedIntermediate(t *testing.T) {
+	root, rootKey := createAIATestCert(t, "Test Root", nil, nil, "")
+	caBundleRoots = x509.NewCertPool()
+	defer func() { caBundleRoots = nil }()
+	intermediate, intermediateKey := createAIATestCert(t, "Test Intermediate", root, rootKey, serveAIATestCert(t, root))
+	leaf, _ := createAIATestCert(t, "matrix.example.com", intermediate, intermediateKey, serveAIATestCert(t, intermediate))
+
+	// The chain is complete but ends at a private intermediate, fetching its issuer doesn't help.
+	testIncompleteChain(t, []*x509.Certificate{leaf, intermediate}, false)
+	testIncompleteChain(t, []*x509.Certificate{leaf}, false)
+}
+
+func TestIncompleteChainNoIssuerURL(t *testing.T) {
+	root, rootKey := createAIATestCert(t, "Test Root", nil, nil, "")
+	caBundleRoots = x509.NewCertPool()
+	caBundleRoots.AddCert(root)
+	defer func() { caBundleRoots = nil }()
+	intermediate, intermediateKey := createAIATestCert(t, "Test Intermediate", root, rootKey, "")
+	leaf, _ := createAIATestCert(t, "matrix.example.com", intermediate, intermediateKey, "")
+
+	testIncompleteChain(t, []*x509.Certificate{leaf}, false)
+}
+
+func TestIncompleteChainOnlyFetchesHTTP(t *testing.T) {
+	root, rootKey := createAIATestCert(t, "Test Root", nil, nil, "")
+	caBundleRoots = x509.NewCertPool()
+	caBundleRoots.AddCert(root)
+	defer func() { caBundleRoots = nil }()
+	intermediate, intermediateKey := createAIATestCert(t, "Test Intermediate", root, rootKey, "")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(intermediate.Raw)
+	}))
+	defer server.Close()
+	leaf, _ := createAIATestCert(t, "matrix.example.com", intermediate, intermediateKey, server.URL)
+
+	testIncompleteChain(t, []*x509.Certificate{leaf}, false)
+}
+
+func TestIncompleteChainStopsAtDeadline(t *testing.T) {
+	root, rootKey := createAIATestCert(t, "Test Root", nil, nil, "")
+	caBundleRoots = x509.NewCertPool()
+	caBundleRoots.AddCert(root)
+	defer func() { caBundleRoots = nil }()
+	intermediate, intermediateKey := createAIATestCert(t, "Test Intermediate", root, rootKey, "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		w.Write(intermediate.Raw)
+	}))
+	defer server.Close()
+	leaf, _ := createAIATestCert(t, "matrix.example.com", intermediate, intermediateKey, server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	now := time.Now()
+	if isIncompleteChain(ctx, []*x509.Certificate{leaf}, verifyChain([]*x509.Certificate{leaf}, now), now) {
+		t.Errorf("isIncompleteChain: want false when the fetch runs out of time got true")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("isIncompleteChain: want it to stop at the deadline got %v", elapsed)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// A BackendDifference is a part of the responses that differed between the addresses of a server.
+type BackendDifference struct {
+	Field  string              // What differed: "verify_keys" or "version".
+	Values map[string][]string // The sorted addresses that returned each value, keyed by the value.
+}
+
+// compareBackends compares the key documents and versions returned by each address
+// that connected, since a load balancer in front of backends that are configured
+// differently makes federation work only some of the time.
+// Sets InconsistentBackends and BackendDifferences if any of them differ.
+// Addresses whose version couldn't be fetched are left out of the version comparison.
+func (report *ServerReport) compareBackends() {
+	verifyKeys := map[string][]string{}
+	versions := map[string][]string{}
+	for _, addr := range sortedAddrs(report.ConnectionReports) {
+		connReport := report.ConnectionReports[addr]
+		keys := verifyKeysValue(connReport.VerifyKeys)
+		verifyKeys[keys] = append(verifyKeys[keys], addr)
+		if connReport.Version.Error == nil {
+			version := strings.TrimSpace(connReport.Version.Name + " " + connReport.Version.Version)
+			versions[version] = append(versions[version], addr)
+		}
+	}
+	if len(verifyKeys) > 1 {
+		report.BackendDifferences = append(report.BackendDifferences, BackendDifference{"verify_keys", verifyKeys})
+	}
+	if len(versions) > 1 {
+		report.BackendDifferences = append(report.BackendDifferences, BackendDifference{"version", versions})
+	}
+	report.InconsistentBackends = len(report.BackendDifferences) > 0
+}
+
+// verifyKeysValue returns the verify keys of a key document as a sorted,
+// comma separated list of "<key ID>=<key>" for comparing between addresses.
+func verifyKeysValue(verifyKeys map[string]VerifyKey) string {
+	var keys []string
+	for keyID, key := range verifyKeys {
+		keys = append(keys, keyID+"="+key.Key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sync"
+)
+
+// The maximum number of servers in a single batch request.
+const maxBatchSize = 50
+
+// The number of servers in a batch that are reported on concurrently.
+const batchWorkers = 8
+
+// A BatchRequest is a request for reports on several matrix servers.
+type BatchRequest struct {
+	Servers []ReportRequest `json:"servers"` // The servers to report on.
+}
+
+// A BatchLine is a line of a streamed batch response, see streamBatch.
+type BatchLine struct {
+	ServerName string        // The name of the server the line is about.
+	Report     *ServerReport `json:",omitempty"` // The report on the server, or nil if there was an error.
+	Error      *ReportError  `json:",omitempty"` // Why the report couldn't be generated, or nil if there is a report.
+}
+
+// The media type of streamed batch responses.
+const ndjsonMediaType = "application/x-ndjson"
+
+// HandleReportBatch handles an HTTP request for JSON reports for several matrix servers.
+// POST /api/report-batch {"servers": [{"server_name": "matrix.org", "tls_sni": "whatever"}]} request.
+// Responds with a JSON object mapping each server name to either its report or an ErrorResponse.
+// If the request has an "Accept: application/x-ndjson" header then the reports are streamed instead, see streamBatch.
+// Each server in the batch counts as a request towards the rate limit.
+func HandleReportBatch(w http.ResponseWriter, req *http.Request) {
+	setCORSHeaders(w, "POST")
+	if req.Method == "OPTIONS" {
+		return
+	}
+	if req.Method != "POST" {
+		writeJSONError(w, 405, fmt.Errorf("Unsupported method %q", req.Method))
+		return
+	}
+	var batch BatchRequest
+	if err := decodeJSONBody(req, &batch); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	if err := batch.validate(); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	if !rateLimitReports(w, req, len(batch.Servers)) {
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(req.Header.Get("Accept")); err == nil && mediaType == ndjsonMediaType {
+		streamBatch(w, req, batch.Servers)
+		return
+	}
+	encoded, err := json.MarshalIndent(batchReport(req.Context(), batch.Servers), "", "  ")
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(encoded)
+}
+
+// validate checks that the batch isn't empty or too big and that each request in it is valid.
+// Each server can only be listed once, even with different parameters, since the
+// results are keyed by server name and one report would overwrite the other.
+func (b *BatchRequest) validate() error {
+	if len(b.Servers) == 0 {
+		return fmt.Errorf("No servers in batch")
+	}
+	if len(b.Servers) > maxBatchSize {
+		return fmt.Errorf("Too many servers in batch: %d > %d", len(b.Servers), maxBatchSize)
+	}
+	seen := map[string]bool{}
+	for i := range b.Servers {
+		if err := b.Servers[i].validate(); err != nil {
+			return fmt.Errorf("Invalid server %d in batch: %v", i, err)
+		}
+		// The server names have been normalized by validate.
+		if seen[b.Servers[i].ServerName] {
+			return fmt.Errorf("Server %q is in batch more than once", b.Servers[i].ServerName)
+		}
+		seen[b.Servers[i].ServerName] = true
+	}
+	return nil
+}
+
+// streamBatch writes a line of JSON for each of the servers as soon as its report
+// is finished, flushing after each line so that clients can show progress.
+// Each line is a BatchLine. The lines are in the order the reports finished.
+func streamBatch(w http.ResponseWriter, req *http.Request, requests []ReportRequest) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", ndjsonMediaType)
+	w.WriteHeader(200)
+	eachBatchReport(req.Context(), requests, func(serverName string, report *ServerReport, err error) {
+		if err == errReportCancelled {
+			// The client has gone away so there's no one to send the line to.
+			return
+		}
+		line := BatchLine{ServerName: serverName, Report: report}
+		if err != nil {
+			reportErr := toReportError(err, "")
+			line.Error = &reportErr
+		}
+		encoded, encodeErr := json.Marshal(line)
+		if encodeErr != nil {
+			encoded, _ = json.Marshal(BatchLine{ServerName: serverName, Error: &ReportError{Message: encodeErr.Error()}})
+		}
+		w.Write(append(encoded, '\n'))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+}
+
+// batchReport reports on each of the servers using a pool of batchWorkers.
+// Returns a map from server name to either a *ServerReport or an ErrorResponse.
+func batchReport(ctx context.Context, requests []ReportRequest) map[string]interface{} {
+	results := map[string]interface{}{}
+	eachBatchReport(ctx, requests, func(serverName string, report *ServerReport, err error) {
+		if err != nil {
+			results[serverName] = ErrorResponse{toReportError(err, "")}
+		} else {
+			results[serverName] = report
+		}
+	})
+	return results
+}
+
+// eachBatchReport reports on each of the servers using a pool of batchWorkers,
+// calling done with the result of each report as it finishes.
+// The calls to done are never concurrent.
+func eachBatchReport(ctx context.Context, requests []ReportRequest, done func(serverName string, report *ServerReport, err error)) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan ReportRequest)
+	for i := 0; i < batchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for request := range work {
+				report, err := cachedReport(ctx, request)
+				mutex.Lock()
+				done(request.ServerName, report, err)
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, request := range requests {
+		work <- request
+	}
+	close(work)
+	wg.Wait()
+}
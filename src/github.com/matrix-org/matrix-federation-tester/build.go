@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the version of the tester. It is set when building a release using
+// go build -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// matrixFederationVersion is the version of the golang-matrixfederation library the tester was built with.
+// gb doesn't record the versions of vendored packages in the binary, so release builds set it using
+// go build -ldflags "-X main.matrixFederationVersion=<revision>" with the revision from vendor/manifest.
+var matrixFederationVersion string
+
+// The import path of the golang-matrixfederation library.
+const matrixFederationPath = "github.com/matrix-org/golang-matrixfederation"
+
+// userAgent is the User-Agent header sent with every HTTP request the tester makes,
+// so that the admins of the servers we probe can see what is making the requests.
+// It defaults to defaultUserAgent() and can be set using the USER_AGENT environment variable.
+var userAgent string
+
+// defaultUserAgent returns "matrix-federation-tester/<version>".
+// This is a function rather than a variable initialiser so that it uses the version set by -ldflags.
+func defaultUserAgent() string {
+	return "matrix-federation-tester/" + version
+}
+
+// A VersionInfo describes the build of the tester.
+type VersionInfo struct {
+	Version                 string // The version of the tester, "dev" if it isn't a release build.
+	GoVersion               string // The version of go the tester was built with.
+	MatrixFederationVersion string // The version of golang-matrixfederation the tester was built with, or "unknown".
+}
+
+// buildVersionInfo returns the VersionInfo for this build.
+// The golang-matrixfederation version comes from the module build info if the
+// tester was built as a module, otherwise from matrixFederationVersion.
+func buildVersionInfo() VersionInfo {
+	info := VersionInfo{
+		Version:                 version,
+		GoVersion:               runtime.Version(),
+		MatrixFederationVersion: matrixFederationVersion,
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range buildInfo.Deps {
+			if dep.Path == matrixFederationPath {
+				info.MatrixFederationVersion = dep.Version
+			}
+		}
+	}
+	if info.MatrixFederationVersion == "" {
+		info.MatrixFederationVersion = "unknown"
+	}
+	return info
+}
+
+// HandleVersion handles an HTTP request for the VersionInfo of the tester.
+// GET /version request.
+func HandleVersion(w http.ResponseWriter, req *http.Request) {
+	setCORSHeaders(w, "GET")
+	if req.Method == "OPTIONS" {
+		return
+	}
+	if req.Method != "GET" {
+		writeJSONError(w, 405, fmt.Errorf("Unsupported method %q", req.Method))
+		return
+	}
+	encoded, err := json.MarshalIndent(buildVersionInfo(), "", "  ")
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(encoded)
+}
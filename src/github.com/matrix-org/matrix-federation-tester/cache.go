@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// reportCacheTTL is how long a generated report is served from the cache.
+// It can be set using the REPORT_CACHE_TTL_SECONDS environment variable.
+// A TTL of zero disables the cache.
+var reportCacheTTL = 60 * time.Second
+
+// reports is the cache of recently generated reports used by HandleReport.
+var reports reportCache
+
+// A reportCache holds recently generated reports so that repeated requests
+// for the same server don't probe it again.
+// The reports are keyed by the request that generated them.
+type reportCache struct {
+	mutex     sync.Mutex
+	entries   map[ReportRequest]*ServerReport
+	lastSweep time.Time
+}
+
+// get returns a copy of the cached report for the request marked as Cached,
+// or nil if there isn't a report younger than the TTL.
+// The report must not be modified by the caller.
+func (c *reportCache) get(request ReportRequest, now time.Time) *ServerReport {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	report := c.entries[request]
+	if report == nil {
+		return nil
+	}
+	if now.Sub(report.GeneratedAt) >= reportCacheTTL {
+		delete(c.entries, request)
+		return nil
+	}
+	cached := *report
+	cached.Cached = true
+	return &cached
+}
+
+// size returns the number of reports in the cache.
+func (c *reportCache) size() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// put adds a report to the cache. The report must not be modified after it is added.
+// Expired entries are swept out of the cache at most once per TTL.
+func (c *reportCache) put(request ReportRequest, report *ServerReport, now time.Time) {
+	if reportCacheTTL <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = map[ReportRequest]*ServerReport{}
+	}
+	if now.Sub(c.lastSweep) >= reportCacheTTL {
+		for key, entry := range c.entries {
+			if now.Sub(entry.GeneratedAt) >= reportCacheTTL {
+				delete(c.entries, key)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[request] = report
+}
+
+// setCacheHeaders sets the headers allowing browsers and proxies to cache a report
+// for as long as it will be served from the report cache, so that they don't serve
+// it for longer than we would or fetch it again while we'd return the same report.
+func setCacheHeaders(w http.ResponseWriter, report *ServerReport, now time.Time) {
+	remaining := report.GeneratedAt.Add(reportCacheTTL).Sub(now) / time.Second * time.Second
+	if remaining <= 0 {
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(remaining/time.Second)))
+	w.Header().Set("Expires", now.Add(remaining).UTC().Format(http.TimeFormat))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// verifyCertChain controls whether the certificate chain served by each address is verified against the system roots.
+// Matrix federation historically trusted certificates using the TLS fingerprints in the key document,
+// so this can be turned off by setting the SKIP_CHAIN_VERIFICATION environment variable to "1".
+var verifyCertChain = true
+
+// caBundleRoots are the roots certificate chains are verified against instead of the system roots, or nil to use the system roots.
+// It can be loaded from a PEM file using the CA_BUNDLE_PATH environment variable,
+// so that federations using an internal CA can be tested.
+var caBundleRoots *x509.CertPool
+
+// The trust stores that certificate chains are verified against, see ConnectionReport.TrustStore.
+const (
+	trustStoreSystem   = "system"
+	trustStoreCABundle = "ca_bundle"
+)
+
+// loadCABundle reads the certificates in a PEM file into a pool of roots.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates were found in %s", path)
+	}
+	return roots, nil
+}
+
+// trustStore returns which trust store certificate chains are verified against.
+func trustStore() string {
+	if caBundleRoots != nil {
+		return trustStoreCABundle
+	}
+	return trustStoreSystem
+}
+
+// summarizeCertificate creates a X509CertSummary for a certificate, computing its expiry relative to now.
+func summarizeCertificate(cert *x509.Certificate, now time.Time) X509CertSummary {
+	fingerprint := sha256.Sum256(cert.Raw)
+	untilExpiry := cert.NotAfter.Sub(now)
+	return X509CertSummary{
+		SubjectCommonName:  cert.Subject.CommonName,
+		IssuerCommonName:   cert.Issuer.CommonName,
+		SHA256Fingerprint:  fingerprint[:],
+		DNSNames:           cert.DNSNames,
+		IPAddresses:        ipStrings(cert.IPAddresses),
+		NotBefore:          cert.NotBefore,
+		NotAfter:           cert.NotAfter,
+		Expired:            untilExpiry < 0,
+		DaysUntilExpiry:    int(math.Floor(untilExpiry.Hours() / 24)),
+		IsCA:               cert.IsCA,
+		SelfSigned:         isSelfSigned(cert),
+		PublicKeyAlgorithm: cert.PublicKeyAlgorithm.String(),
+		PublicKeyBits:      publicKeyBits(cert),
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+	}
+}
+
+// certExpiryWarningDays is how many days before a certificate in the chain expires that we warn about it.
+const certExpiryWarningDays = 14
+
+// chainExpiry returns the earliest NotAfter of the certificates in a chain and the
+// whole days until then, so that intermediates expiring before the leaf are caught.
+// Returns the zero time and 0 if there aren't any certificates.
+func chainExpiry(certs []X509CertSummary) (time.Time, int) {
+	var expiresAt time.Time
+	var days int
+	for i, cert := range certs {
+		if i == 0 || cert.NotAfter.Before(expiresAt) {
+			expiresAt, days = cert.NotAfter, cert.DaysUntilExpiry
+		}
+	}
+	return expiresAt, days
+}
+
+// minRSAKeyBits is the smallest RSA key that isn't warned about, following the CA/Browser forum baseline requirements.
+const minRSAKeyBits = 2048
+
+// publicKeyBits returns the size of a certificate's public key in bits, or 0 if the algorithm isn't known.
+func publicKeyBits(cert *x509.Certificate) int {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return len(key) * 8
+	}
+	return 0
+}
+
+// isWeakRSAKey returns true if the certificate has an RSA key smaller than minRSAKeyBits.
+func isWeakRSAKey(cert X509CertSummary) bool {
+	return cert.PublicKeyAlgorithm == x509.RSA.String() && cert.PublicKeyBits < minRSAKeyBits
+}
+
+// isSHA1Signature returns true if the certificate is signed using SHA-1, which is deprecated
+// since SHA-1 collisions are practical and which go and most browsers refuse to verify.
+func isSHA1Signature(cert X509CertSummary) bool {
+	switch cert.SignatureAlgorithm {
+	case x509.SHA1WithRSA.String(), x509.DSAWithSHA1.String(), x509.ECDSAWithSHA1.String():
+		return true
+	}
+	return false
+}
+
+// coversName returns true if one of the DNS names from a certificate's subject alternative names matches the name,
+// and whether it only matched a wildcard name.
+// Names are compared case insensitively. Wildcards are matched following RFC 6125 section 6.4.3 as
+// restricted by browsers: the wildcard must be the whole leftmost label and matches exactly one label of the name,
+// and names where "*" appears anywhere else are ignored, e.g. "*.*.example.com" or "f*.example.com".
+// The common name is ignored since modern TLS clients ignore it.
+func coversName(dnsNames []string, name string) (covered, viaWildcard bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, pattern := range dnsNames {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if pattern == name && !strings.Contains(pattern, "*") {
+			return true, false
+		}
+		if matchesWildcard(pattern, name) {
+			viaWildcard = true
+		}
+	}
+	return viaWildcard, viaWildcard
+}
+
+// certCoversName returns whether the subject alternative names of a certificate cover a name like coversName,
+// except that if the name is an IP address it is matched against the IP addresses instead of the DNS names.
+func certCoversName(cert X509CertSummary, name string) (covered, viaWildcard bool) {
+	ip := net.ParseIP(name)
+	if ip == nil {
+		return coversName(cert.DNSNames, name)
+	}
+	for _, address := range cert.IPAddresses {
+		if ip.Equal(net.ParseIP(address)) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// ipStrings formats a list of IP addresses.
+func ipStrings(ips []net.IP) []string {
+	var strs []string
+	for _, ip := range ips {
+		strs = append(strs, ip.String())
+	}
+	return strs
+}
+
+// matchesWildcard returns true if the pattern is a valid wildcard name that matches the name.
+// Both must already be lower case.
+func matchesWildcard(pattern, name string) bool {
+	suffix := strings.TrimPrefix(pattern, "*")
+	// The wildcard must be followed by at least two labels so that "*.com" doesn't match every .com name.
+	if suffix == pattern || strings.Contains(suffix, "*") || strings.Count(suffix, ".") < 2 || suffix[0] != '.' {
+		return false
+	}
+	dot := strings.IndexByte(name, '.')
+	return dot > 0 && name[dot:] == suffix
+}
+
+// isSelfSigned returns true if the certificate's issuer is its subject and it is signed by its own key.
+func isSelfSigned(cert *x509.Certificate) bool {
+	// CheckSignatureFrom would reject self-signed leaf certificates that aren't marked as a CA.
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// verifyChain checks that the certificates served by a server build a chain to a trusted root,
+// which is one of the caBundleRoots if they were loaded and a system root otherwise.
+// The first certificate is the leaf and the rest are used as intermediates.
+// Returns nil if the chain verified.
+func verifyChain(certs []*x509.Certificate, now time.Time) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("No certificates were presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         caBundleRoots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+	})
+	return err
+}
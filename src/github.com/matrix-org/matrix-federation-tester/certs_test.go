@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCoversName(t *testing.T, dnsNames []string, name string, wantCovered, wantViaWildcard bool) {
+	covered, viaWildcard := coversName(dnsNames, name)
+	if covered != wantCovered || viaWildcard != wantViaWildcard {
+		t.Errorf("coversName(%q, %q): want (%v, %v) got (%v, %v)", dnsNames, name, wantCovered, wantViaWildcard, covered, viaWildcard)
+	}
+}
+
+func TestCoversNameExact(t *testing.T) {
+	testCoversName(t, []string{"matrix.example.com"}, "matrix.example.com", true, false)
+	testCoversName(t, []string{"example.com", "Matrix.Example.COM"}, "matrix.example.com", true, false)
+	testCoversName(t, []string{"matrix.example.com."}, "matrix.example.com", true, false)
+	testCoversName(t, []string{"example.com"}, "matrix.example.com", false, false)
+	testCoversName(t, nil, "matrix.example.com", false, false)
+}
+
+func TestCoversNameWildcard(t *testing.T) {
+	testCoversName(t, []string{"*.example.com"}, "matrix.example.com", true, true)
+	testCoversName(t, []string{"*.Example.com"}, "MATRIX.example.com", true, true)
+	testCoversName(t, []string{"*.example.com"}, "example.com", false, false)
+	testCoversName(t, []string{"*.example.com"}, "a.matrix.example.com", false, false)
+	// An exact match takes precedence over a wildcard.
+	testCoversName(t, []string{"*.example.com", "matrix.example.com"}, "matrix.example.com", true, false)
+}
+
+func TestCoversNameInvalidWildcard(t *testing.T) {
+	testCoversName(t, []string{"*.*.example.com"}, "a.matrix.example.com", false, false)
+	testCoversName(t, []string{"*.*.example.com"}, "*.matrix.example.com", false, false)
+	testCoversName(t, []string{"m*.example.com"}, "matrix.example.com", false, false)
+	testCoversName(t, []string{"matrix.*.com"}, "matrix.example.com", false, false)
+	testCoversName(t, []string{"*.com"}, "example.com", false, false)
+	testCoversName(t, []string{"*"}, "example", false, false)
+}
+
+func TestCertCoversNameIPAddress(t *testing.T) {
+	cert := X509CertSummary{DNSNames: []string{"matrix.example.com"}, IPAddresses: []string{"192.0.2.1", "2001:db8::1"}}
+	for name, want := range map[string]bool{
+		"192.0.2.1":          true,
+		"2001:db8::1":        true,
+		"2001:DB8:0::1":      true,
+		"192.0.2.2":          false,
+		"matrix.example.com": true,
+	} {
+		if covered, _ := certCoversName(cert, name); covered != want {
+			t.Errorf("certCoversName(%q): want %v got %v", name, want, covered)
+		}
+	}
+	if covered, _ := certCoversName(X509CertSummary{DNSNames: []string{"192.0.2.1"}}, "192.0.2.1"); covered {
+		t.Errorf("certCoversName: want an IP address in the DNS names not to cover it got true")
+	}
+}
+
+// createTestCert creates a self-signed certificate for matrix.example.com with the given key and signature algorithm.
+func createTestCert(t *testing.T, key crypto.Signer, signatureAlgorithm x509.SignatureAlgorithm) *x509.Certificate {
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:       big.NewInt(1),
+		Subject:            pkix.Name{CommonName: "matrix.example.com"},
+		DNSNames:           []string{"matrix.example.com"},
+		NotBefore:          now.Add(-time.Hour),
+		NotAfter:           now.Add(30 * 24 * time.Hour),
+		SignatureAlgorithm: signatureAlgorithm,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(%v): %v", signatureAlgorithm, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(%v): %v", signatureAlgorithm, err)
+	}
+	return cert
+}
+
+func generateRSAKey(t *testing.T, bits int) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey(%d): %v", bits, err)
+	}
+	return key
+}
+
+// testCertWarnings checks the key size and signature algorithm of a certificate and
+// whether serving it produces a warning containing each of the wanted strings, or no warnings if there are none.
+func testCertWarnings(t *testing.T, cert *x509.Certificate, wantBits int, wantSignatureAlgorithm string, wantWarnings ...string) {
+	now := time.Now()
+	summary := summarizeCertificate(cert, now)
+	if summary.PublicKeyBits != wantBits {
+		t.Errorf("PublicKeyBits: want %d got %d", wantBits, summary.PublicKeyBits)
+	}
+	if summary.SignatureAlgorithm != wantSignatureAlgorithm {
+		t.Errorf("SignatureAlgorithm: want %q got %q", wantSignatureAlgorithm, summary.SignatureAlgorithm)
+	}
+	// The certificates are self-signed to keep the test simple, which isn't what is being tested.
+	summary.SelfSigned = false
+	connReport := ConnectionReport{
+		Certificates:     []X509CertSummary{summary},
+		CoversServerName: true,
+		KeyValidUntil:    now.Add(7 * 24 * time.Hour),
+	}
+	warnings := connectionWarnings("1.2.3.4:8448", connReport, now)
+	if len(warnings) != len(wantWarnings) {
+		t.Fatalf("connectionWarnings: want %d warnings got %q", len(wantWarnings), warnings)
+	}
+	for i, want := range wantWarnings {
+		if !strings.Contains(warnings[i].Message, want) {
+			t.Errorf("connectionWarnings: want a warning containing %q got %q", want, warnings[i])
+		}
+	}
+}
+
+func TestCertWarningsStrongRSA(t *testing.T) {
+	cert := createTestCert(t, generateRSAKey(t, 2048), x509.SHA256WithRSA)
+	testCertWarnings(t, cert, 2048, "SHA256-RSA")
+}
+
+func TestCertWarningsWeakRSA(t *testing.T) {
+	cert := createTestCert(t, generateRSAKey(t, 1024), x509.SHA256WithRSA)
+	testCertWarnings(t, cert, 1024, "SHA256-RSA", "1024 bit RSA key")
+}
+
+func TestCertWarningsSHA1(t *testing.T) {
+	cert := createTestCert(t, generateRSAKey(t, 2048), x509.SHA1WithRSA)
+	testCertWarnings(t, cert, 2048, "SHA1-RSA", "SHA-1")
+}
+
+func TestCertWarningsECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	// ECDSA keys are much smaller than RSA keys of the same strength so they aren't flagged.
+	cert := createTestCert(t, key, x509.ECDSAWithSHA256)
+	testCertWarnings(t, cert, 256, "ECDSA-SHA256")
+}
+
+func TestChainExpiryIntermediate(t *testing.T) {
+	now := time.Now()
+	leaf := X509CertSummary{ChainIndex: 0, NotAfter: now.Add(60 * 24 * time.Hour), DaysUntilExpiry: 60}
+	intermediate := X509CertSummary{ChainIndex: 1, SubjectCommonName: "Example CA", NotAfter: now.Add(5 * 24 * time.Hour), DaysUntilExpiry: 5}
+	expiresAt, days := chainExpiry([]X509CertSummary{leaf, intermediate})
+	if !expiresAt.Equal(intermediate.NotAfter) || days != 5 {
+		t.Errorf("chainExpiry: want %v, 5 got %v, %d", intermediate.NotAfter, expiresAt, days)
+	}
+	connReport := ConnectionReport{
+		Certificates:     []X509CertSummary{leaf, intermediate},
+		CoversServerName: true,
+		KeyValidUntil:    now.Add(7 * 24 * time.Hour),
+	}
+	warnings := connectionWarnings("1.2.3.4:8448", connReport, now)
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "certificate 1 in the chain") {
+		t.Errorf("connectionWarnings: want a warning about the intermediate got %q", warnings)
+	}
+}
+
+func TestWarningsCertForOriginalServerName(t *testing.T) {
+	coversOriginal := true
+	report := ServerReport{
+		ServerName:     "example.com",
+		ConnectionHost: "matrix.example.com",
+		GeneratedAt:    time.Now(),
+		ConnectionReports: map[string]ConnectionReport{"1.2.3.4:8448": {
+			Certificates:       []X509CertSummary{{DNSNames: []string{"example.com"}, DaysUntilExpiry: 60}},
+			CoversOriginalName: &coversOriginal,
+			KeyValidUntil:      time.Now().Add(7 * 24 * time.Hour),
+		}},
+	}
+	report.collectWarnings()
+	if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0].Message, "delegated to matrix.example.com") {
+		t.Errorf("collectWarnings: want a warning about the delegation got %q", report.Warnings)
+	} else if report.Warnings[0].Code != warnCertOriginalName || report.Warnings[0].Address != "1.2.3.4:8448" {
+		t.Errorf("collectWarnings: want code %q for 1.2.3.4:8448 got %q for %q", warnCertOriginalName, report.Warnings[0].Code, report.Warnings[0].Address)
+	}
+}
+
+func TestSummarizeCertificateDaysUntilExpiry(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := createTestCert(t, key, x509.ECDSAWithSHA256)
+	for _, test := range []struct {
+		sinceExpiry time.Duration
+		wantDays    int
+		wantExpired bool
+	}{
+		{-36 * time.Hour, 1, false},
+		{-12 * time.Hour, 0, false},
+		{12 * time.Hour, -1, true},
+		{36 * time.Hour, -2, true},
+	} {
+		summary := summarizeCertificate(cert, cert.NotAfter.Add(test.sinceExpiry))
+		if summary.DaysUntilExpiry != test.wantDays || summary.Expired != test.wantExpired {
+			t.Errorf("summarizeCertificate %v after expiry: want %d days, expired %v got %d days, expired %v", test.sinceExpiry, test.wantDays, test.wantExpired, summary.DaysUntilExpiry, summary.Expired)
+		}
+	}
+}
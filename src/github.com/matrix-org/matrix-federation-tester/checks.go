@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"github.com/matrix-org/golang-matrixfederation"
+	"sort"
+	"strings"
+)
+
+// The keys of ConnectionReport.ChecksSummary. These are stable across versions
+// so that dashboards don't depend on the field names in matrixfederation.KeyChecks.
+// Checks that matrixfederation.KeyChecks reports as null because there was
+// nothing to check are reported as false.
+const (
+	checkAllChecksOK               = "all_checks_ok"                 // Did all the key checks pass?
+	checkMatchingServerName        = "matching_server_name"          // The server name in the keys matches the requested server name.
+	checkFutureValidUntilTS        = "future_valid_until_ts"         // The keys' valid_until_ts is in the future.
+	checkHasEd25519Key             = "has_ed25519_key"               // The keys include at least one ed25519 key.
+	checkAllEd25519ChecksOK        = "all_ed25519_checks_ok"         // Every ed25519 key is valid and has signed the keys.
+	checkHasTLSFingerprint         = "has_tls_fingerprint"           // The keys include at least one TLS fingerprint.
+	checkAllTLSFingerprintChecksOK = "all_tls_fingerprint_checks_ok" // Every TLS fingerprint is a valid SHA-256 hash.
+	checkMatchingTLSFingerprint    = "matching_tls_fingerprint"      // The fingerprint of the certificate served matches one in the keys, see also checkFingerprint.
+)
+
+// summarizeChecks flattens the key checks into a map from the stable check names to whether the check passed.
+func summarizeChecks(checks matrixfederation.KeyChecks) map[string]bool {
+	return map[string]bool{
+		checkAllChecksOK:               checks.AllChecksOK,
+		checkMatchingServerName:        checks.MatchingServerName,
+		checkFutureValidUntilTS:        checks.FutureValidUntilTS,
+		checkHasEd25519Key:             checks.HasEd25519Key,
+		checkAllEd25519ChecksOK:        isTrue(checks.AllEd25519ChecksOK),
+		checkHasTLSFingerprint:         checks.HasTLSFingerprint,
+		checkAllTLSFingerprintChecksOK: isTrue(checks.AllTLSFingerprintChecksOK),
+		checkMatchingTLSFingerprint:    isTrue(checks.MatchingTLSFingerprint),
+	}
+}
+
+// isTrue returns true if the pointer is not nil and points to true.
+func isTrue(value *bool) bool {
+	return value != nil && *value
+}
+
+// verdictChecks are the checks that a connection must pass for federation to
+// be OK, keyed by the stable names used in the skip_checks parameter.
+// Together they are equivalent to matrixfederation.KeyChecks.AllChecksOK.
+var verdictChecks = map[string]func(checks matrixfederation.KeyChecks) bool{
+	// The server name in the keys matches the requested server name.
+	"server_name": func(checks matrixfederation.KeyChecks) bool { return checks.MatchingServerName },
+	// The keys' valid_until_ts is in the future.
+	"valid_until_ts": func(checks matrixfederation.KeyChecks) bool { return checks.FutureValidUntilTS },
+	// The keys include an ed25519 key and every ed25519 key has signed them.
+	"ed25519": func(checks matrixfederation.KeyChecks) bool {
+		return checks.HasEd25519Key && isTrue(checks.AllEd25519ChecksOK)
+	},
+	// The fingerprint of the certificate served is one of the valid tls_fingerprints in the keys.
+	"tls_fingerprint": func(checks matrixfederation.KeyChecks) bool {
+		return isTrue(checks.AllTLSFingerprintChecksOK) && isTrue(checks.MatchingTLSFingerprint)
+	},
+}
+
+// parseSkipChecks parses a comma separated list of verdictChecks names.
+// Returns the names sorted and without duplicates, or an error if any of them isn't a verdictChecks name.
+func parseSkipChecks(list string) ([]string, error) {
+	seen := map[string]bool{}
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if _, ok := verdictChecks[name]; !ok {
+			return nil, fmt.Errorf("Unknown check %q in skip_checks, expected one of %v", name, verdictCheckNames())
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// verdictCheckNames returns the sorted names of the verdictChecks.
+func verdictCheckNames() []string {
+	var names []string
+	for name := range verdictChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// failedChecks returns the sorted names of the verdictChecks that failed, leaving out the skipped ones.
+func failedChecks(checks matrixfederation.KeyChecks, skipped []string) []string {
+	var failed []string
+	for _, name := range verdictCheckNames() {
+		if !verdictChecks[name](checks) && !containsString(skipped, name) {
+			failed = append(failed, name)
+		}
+	}
+	return failed
+}
+
+// containsString returns true if the list contains the value.
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"strings"
+)
+
+// The grades given to the negotiated cipher suite.
+const (
+	gradeStrong     = "strong"     // Forward secret with an AEAD cipher.
+	gradeAcceptable = "acceptable" // Not broken, but without forward secrecy or using CBC mode.
+	gradeWeak       = "weak"       // 3DES, which is vulnerable to Sweet32.
+	gradeInsecure   = "insecure"   // RC4, which is broken.
+	gradeUnknown    = "unknown"    // A cipher suite missing from tlsCipherSuites.
+)
+
+// gradeCipher grades the cipher suite negotiated for a TLS version and reports whether it has forward secrecy.
+// The grade is derived from the name of the suite in tlsCipherSuites.
+func gradeCipher(version, cipherSuite uint16) (grade string, forwardSecrecy bool) {
+	if version >= tls.VersionTLS13 {
+		// Every TLS 1.3 suite uses an AEAD cipher with an ephemeral key exchange.
+		return gradeStrong, true
+	}
+	name, ok := tlsCipherSuites[cipherSuite]
+	if !ok {
+		return gradeUnknown, false
+	}
+	forwardSecrecy = strings.HasPrefix(name, "TLS_ECDHE_")
+	switch {
+	case strings.Contains(name, "_RC4_"):
+		return gradeInsecure, forwardSecrecy
+	case strings.Contains(name, "_3DES_"):
+		return gradeWeak, forwardSecrecy
+	case forwardSecrecy && (strings.Contains(name, "_GCM_") || strings.Contains(name, "_CHACHA20_")):
+		return gradeStrong, forwardSecrecy
+	}
+	return gradeAcceptable, forwardSecrecy
+}
+
+// isWeakGrade returns true if the grade is bad enough to warn about.
+func isWeakGrade(grade string) bool {
+	return grade == gradeWeak || grade == gradeInsecure
+}
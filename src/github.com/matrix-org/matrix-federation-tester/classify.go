@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"syscall"
+)
+
+// classifyError rewrites the common low-level errors from a stage of probing
+// a server address into a ReportError that suggests what is wrong.
+// The original error is kept in the Raw field of the ReportError.
+// Errors that aren't recognised are returned unchanged.
+func classifyError(stage string, err error) error {
+	if message := describeError(stage, err); message != "" {
+		return ReportError{Code: connectionErrorCode(stageError{stage, err}), Message: message, Raw: err.Error()}
+	}
+	return err
+}
+
+// describeError returns an actionable description of a low-level error, or empty if it isn't recognised.
+func describeError(stage string, err error) string {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	switch {
+	case stage == stageConnect && errors.Is(err, syscall.ECONNREFUSED):
+		return "Connection refused: nothing is listening on the port, check that the matrix server is running and the port is forwarded to it"
+	case stage == stageConnect && (errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)):
+		return "Host unreachable: there is no route to the address, check that the DNS records point at the right address"
+	case stage == stageTLSHandshake && errors.Is(err, syscall.ECONNRESET):
+		return "TLS handshake failed: connection reset, likely a non-TLS or misrouted port"
+	case stage == stageTLSHandshake && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)):
+		return "TLS handshake failed: the server closed the connection, likely a non-TLS or misrouted port"
+	case stage == stageTLSHandshake && errors.As(err, &recordErr):
+		return "TLS handshake failed: the server didn't reply with TLS, likely a plain HTTP port"
+	case stage == stageTLSHandshake && errors.As(err, &alertErr):
+		return "TLS handshake failed: the server rejected the handshake with the alert \"" + alertErr.Error() + "\""
+	case stage == stageKeyFetch && errors.Is(err, syscall.ECONNRESET):
+		return "Fetching the keys failed: connection reset after the TLS handshake, check that the port is routed to the matrix server"
+	case stage == stageKeyFetch && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)):
+		return "Fetching the keys failed: the server closed the connection without a response, check that the port is routed to the matrix server"
+	}
+	return ""
+}
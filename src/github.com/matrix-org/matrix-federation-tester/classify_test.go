@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeListener accepts connections on a local port and passes each of them to handle.
+func fakeListener(t *testing.T, handle func(*net.TCPConn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			handle(conn.(*net.TCPConn))
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func testHandshakeError(t *testing.T, handle func(*net.TCPConn), want string) {
+	addr := fakeListener(t, handle)
+	start := time.Now()
+	_, _, err := dialTLS(context.Background(), addr, "example.com", start, start.Add(5*time.Second))
+	if err == nil {
+		t.Fatalf("dialTLS(%q): want an error got nil", addr)
+	}
+	if stage := errorStage(err); stage != stageTLSHandshake {
+		t.Errorf("dialTLS(%q): want stage %q got %q", addr, stageTLSHandshake, stage)
+	}
+	reportErr, ok := asReportError(err, "").(ReportError)
+	if !ok || !strings.Contains(reportErr.Message, want) {
+		t.Errorf("dialTLS(%q): want an error containing %q got %v", addr, want, err)
+	}
+	if reportErr.Raw == "" {
+		t.Errorf("dialTLS(%q): want the raw error to be kept got %#v", addr, reportErr)
+	}
+	if reportErr.Code != codeTLSHandshake {
+		t.Errorf("dialTLS(%q): want code %q got %#v", addr, codeTLSHandshake, reportErr)
+	}
+}
+
+func TestHandshakeConnectionReset(t *testing.T) {
+	testHandshakeError(t, func(conn *net.TCPConn) {
+		// Read the ClientHello then close with a RST rather than a FIN.
+		conn.Read(make([]byte, 1024))
+		conn.SetLinger(0)
+		conn.Close()
+	}, "connection reset")
+}
+
+func TestHandshakeConnectionClosed(t *testing.T) {
+	testHandshakeError(t, func(conn *net.TCPConn) {
+		conn.Read(make([]byte, 1024))
+		conn.Close()
+	}, "closed the connection")
+}
+
+func TestHandshakePlainHTTP(t *testing.T) {
+	testHandshakeError(t, func(conn *net.TCPConn) {
+		conn.Read(make([]byte, 1024))
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		conn.Close()
+	}, "didn't reply with TLS")
+}
+
+func TestClassifyErrorUnrecognised(t *testing.T) {
+	err := ReportError{Message: "something else"}
+	if got := classifyError(stageTLSHandshake, err); got != err {
+		t.Errorf("classifyError(%v): want the error unchanged got %v", err, got)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	// Close the listener so that nothing is listening on the port.
+	listener.Close()
+	start := time.Now()
+	_, _, err = dialTLS(context.Background(), addr, "example.com", start, start.Add(5*time.Second))
+	if stage := errorStage(err); stage != stageConnect {
+		t.Errorf("dialTLS(%q): want stage %q got %q", addr, stageConnect, stage)
+	}
+	if code := errorCode(err); code != codeConnectionRefused {
+		t.Errorf("dialTLS(%q): want code %q got %q (%v)", addr, codeConnectionRefused, code, err)
+	}
+}
+
+func TestConnectUnroutable(t *testing.T) {
+	// 192.0.2.0/24 is reserved for documentation so nothing answers, and
+	// depending on the routes the dial either times out or is unreachable.
+	addr := "192.0.2.1:8448"
+	start := time.Now()
+	_, _, err := dialTLS(context.Background(), addr, "example.com", start, start.Add(200*time.Millisecond))
+	if stage := errorStage(err); stage != stageConnect {
+		t.Errorf("dialTLS(%q): want stage %q got %q", addr, stageConnect, stage)
+	}
+	code := errorCode(err)
+	if code == codeConnectionRefused {
+		t.Skipf("dialTLS(%q): the network refuses outgoing connections, e.g. in a sandbox", addr)
+	}
+	if code != codeConnectionTimeout && code != codeHostUnreachable {
+		t.Errorf("dialTLS(%q): want code %q or %q got %q (%v)", addr, codeConnectionTimeout, codeHostUnreachable, code, err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// The exit codes of the check command.
+const (
+	exitFederationOK     = 0 // The report was generated and federation is OK.
+	exitFederationFailed = 1 // The report was generated but federation isn't OK.
+	exitError            = 2 // The arguments were invalid or the report couldn't be generated.
+)
+
+// runCheck runs the "check" command, which prints the JSON report for a single server to stdout.
+// matrix-federation-tester check [-tls-sni <sni>] [-timeout <seconds>] <server_name>
+// matrix-federation-tester check [-timeout <seconds>] -input <file>
+// With -input the servers listed in the file are checked instead, see runCheckList.
+// Returns the exit code for the command.
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: matrix-federation-tester check [-tls-sni <sni>] [-timeout <seconds>] <server_name>")
+		fmt.Fprintln(stderr, "       matrix-federation-tester check [-timeout <seconds>] -input <file>")
+		flags.PrintDefaults()
+	}
+	var request ReportRequest
+	flags.StringVar(&request.TLSSNI, "tls-sni", "", "The TLS SNI to send. Defaults to the name of the server we connect to.")
+	flags.IntVar(&request.Timeout, "timeout", 0, "The time allowed to probe each address in seconds. Defaults to CONNECTION_TIMEOUT_SECONDS.")
+	input := flags.String("input", "", "A file listing the servers to check, one \"<server_name> [<tls_sni>]\" per line.")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	if *input != "" {
+		if flags.NArg() != 0 || request.TLSSNI != "" {
+			flags.Usage()
+			return exitError
+		}
+		return runCheckList(*input, request.Timeout, stdout, stderr)
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitError
+	}
+	request.ServerName = flags.Arg(0)
+	if err := request.validate(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	report, err := reportWithOptions(context.Background(), request.ServerName, request.sni(), request.timeout(), request.options())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	report.touchUpReport()
+	encoded, err := encodeReport(report, true)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	fmt.Fprintln(stdout, string(encoded))
+	if !report.FederationOK {
+		return exitFederationFailed
+	}
+	return exitFederationOK
+}
+
+// A CheckListResult is the result of checking a list of servers with "check -input".
+type CheckListResult struct {
+	Total   int                    // The number of servers checked.
+	OK      int                    // The number of servers that federation is OK with.
+	Failed  int                    // The number of servers that federation isn't OK with.
+	Errors  int                    // The number of servers that a report couldn't be generated for.
+	Reports map[string]interface{} // Either the *ServerReport or an ErrorResponse for each server, keyed by server name.
+}
+
+// runCheckList checks each of the servers listed in a file concurrently, using
+// the same pool of workers as /api/report-batch.
+// Prints a table summarizing the results to stderr and a JSON CheckListResult to stdout.
+// Exits with exitError if any report couldn't be generated, otherwise with
+// exitFederationFailed if federation failed with any server.
+func runCheckList(path string, timeout int, stdout, stderr io.Writer) int {
+	requests, err := readServerList(path, timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	result := CheckListResult{Total: len(requests), Reports: map[string]interface{}{}}
+	eachBatchReport(context.Background(), requests, func(serverName string, report *ServerReport, err error) {
+		switch {
+		case err != nil:
+			result.Errors++
+			result.Reports[serverName] = ErrorResponse{toReportError(err, "")}
+		case report.FederationOK:
+			result.OK++
+			result.Reports[serverName] = report
+		default:
+			result.Failed++
+			result.Reports[serverName] = report
+		}
+	})
+	table := tabwriter.NewWriter(stderr, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "SERVER\tRESULT\tDETAILS")
+	for _, request := range requests {
+		switch entry := result.Reports[request.ServerName].(type) {
+		case *ServerReport:
+			status := "FAIL"
+			if entry.FederationOK {
+				status = "OK"
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s (score %d)\n", request.ServerName, status, entry.Verdict, entry.Score)
+		case ErrorResponse:
+			fmt.Fprintf(table, "%s\tERROR\t%s\n", request.ServerName, entry.Error.Message)
+		}
+	}
+	table.Flush()
+	fmt.Fprintf(stderr, "%d servers: %d OK, %d failed, %d errors\n", result.Total, result.OK, result.Failed, result.Errors)
+	encoded, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	fmt.Fprintln(stdout, string(encoded))
+	switch {
+	case result.Errors > 0:
+		return exitError
+	case result.Failed > 0:
+		return exitFederationFailed
+	}
+	return exitFederationOK
+}
+
+// readServerList reads the servers to check from a file.
+// Each line is a server name optionally followed by the TLS SNI to send, separated by whitespace.
+// Blank lines and everything after a "#" are ignored. Each server may only be listed once.
+func readServerList(path string, timeout int) ([]ReportRequest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var requests []ReportRequest
+	seen := map[string]int{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<server_name> [<tls_sni>]\" got %q", path, lineNumber, strings.TrimSpace(line))
+		}
+		request := ReportRequest{ServerName: fields[0], Timeout: timeout}
+		if len(fields) == 2 {
+			request.TLSSNI = fields[1]
+		}
+		if err = request.validate(); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+		if previous, ok := seen[request.ServerName]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is already listed on line %d", path, lineNumber, request.ServerName, previous)
+		}
+		seen[request.ServerName] = lineNumber
+		requests = append(requests, request)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("%s: no servers listed", path)
+	}
+	return requests, nil
+}
+
+// runCommand runs the command given on the command line and returns its exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "check":
+		return runCheck(args[1:], os.Stdout, os.Stderr)
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q, try \"check\"\n", args[0])
+	return exitError
+}
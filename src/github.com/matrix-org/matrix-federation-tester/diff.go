@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// A DiffRequest is a request to compare two reports.
+// Each side is either a report returned by an earlier request or the name of a server to report on now.
+type DiffRequest struct {
+	Before           *reportSnapshot `json:"before"`             // A report from /api/report to compare against.
+	After            *reportSnapshot `json:"after"`              // A report from /api/report to compare with Before.
+	BeforeServerName string          `json:"before_server_name"` // A server to report on now instead of giving Before.
+	AfterServerName  string          `json:"after_server_name"`  // A server to report on now instead of giving After.
+}
+
+// A reportSnapshot holds the parts of a JSON encoded ServerReport that are compared by diffReports.
+type reportSnapshot struct {
+	DNSResult struct {
+		Addrs []string
+	}
+	ConnectionReports map[string]struct {
+		Certificates []struct {
+			SHA256Fingerprint string
+		}
+		Cipher struct {
+			Version     string
+			CipherSuite string
+		}
+		Keys json.RawMessage
+	}
+	FederationOK bool
+}
+
+// A ReportDiff is the difference between two reports.
+type ReportDiff struct {
+	Changed          bool        // Did anything compared change?
+	FederationOK     *BoolChange // The change in FederationOK, or nil if it didn't change.
+	Addrs            SetDiff     // The changes in the addresses the server resolved to.
+	CertFingerprints SetDiff     // The changes in the SHA256 fingerprints of the leaf certificates served.
+	Ciphers          SetDiff     // The changes in the "<version> <cipher suite>" negotiated.
+	KeyIDs           SetDiff     // The changes in the IDs of the verify_keys served.
+}
+
+// A BoolChange is a boolean that changed between two reports.
+type BoolChange struct {
+	Before bool // The value in the earlier report.
+	After  bool // The value in the later report.
+}
+
+// A SetDiff is the change in a set of values between two reports.
+type SetDiff struct {
+	Added   []string // The values in the later report that weren't in the earlier report, sorted.
+	Removed []string // The values in the earlier report that aren't in the later report, sorted.
+}
+
+// HandleDiff handles an HTTP request comparing two reports.
+// POST /api/diff {"before": {...}, "after_server_name": "matrix.org"} request.
+// Responds with a JSON ReportDiff.
+// Each side that names a server to report on counts as a request towards the rate limit.
+func HandleDiff(w http.ResponseWriter, req *http.Request) {
+	setCORSHeaders(w, "POST")
+	if req.Method == "OPTIONS" {
+		return
+	}
+	if req.Method != "POST" {
+		writeJSONError(w, 405, fmt.Errorf("Unsupported method %q", req.Method))
+		return
+	}
+	var request DiffRequest
+	if err := decodeJSONBody(req, &request); err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	if !rateLimitReports(w, req, request.reportCount()) {
+		return
+	}
+	before, err := diffSide(req, request.Before, request.BeforeServerName, "before")
+	if err != nil {
+		writeDiffError(w, err)
+		return
+	}
+	after, err := diffSide(req, request.After, request.AfterServerName, "after")
+	if err != nil {
+		writeDiffError(w, err)
+		return
+	}
+	encoded, err := json.MarshalIndent(diffReports(before, after), "", "  ")
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(encoded)
+}
+
+// reportCount returns the number of reports the request asks to be generated, which is the number of sides given by server name.
+func (r *DiffRequest) reportCount() int {
+	count := 0
+	for _, serverName := range []string{r.BeforeServerName, r.AfterServerName} {
+		if serverName != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// A diffRequestError is an error in a DiffRequest, as opposed to an error generating a report for it.
+type diffRequestError struct{ error }
+
+// writeDiffError writes an error from diffSide with a 400 status if it was the client's fault.
+func writeDiffError(w http.ResponseWriter, err error) {
+	if err == errReportCancelled {
+		// The client has gone away so there's no one to send a response to.
+		return
+	}
+	if _, ok := err.(diffRequestError); ok {
+		writeJSONError(w, 400, err)
+		return
+	}
+	writeJSONError(w, reportErrorStatus(w, err, 500), err)
+}
+
+// diffSide returns one side of a diff, either the report given or a new report on the server.
+// Exactly one of the report or the server name must be given.
+func diffSide(req *http.Request, snapshot *reportSnapshot, serverName, side string) (*reportSnapshot, error) {
+	if (snapshot == nil) == (serverName == "") {
+		return nil, diffRequestError{fmt.Errorf("Exactly one of %q or %q is required", side, side+"_server_name")}
+	}
+	if snapshot != nil {
+		return snapshot, nil
+	}
+	request := ReportRequest{ServerName: serverName, NoCache: true}
+	if err := request.validate(); err != nil {
+		return nil, diffRequestError{fmt.Errorf("Invalid %s: %v", side+"_server_name", err)}
+	}
+	report, err := cachedReport(req.Context(), request)
+	if err != nil {
+		return nil, err
+	}
+	// Round trip the report through JSON so that both kinds of side are compared the same way.
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	var result reportSnapshot
+	if err = json.Unmarshal(encoded, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// diffReports compares two reports.
+func diffReports(before, after *reportSnapshot) ReportDiff {
+	var diff ReportDiff
+	if before.FederationOK != after.FederationOK {
+		diff.FederationOK = &BoolChange{before.FederationOK, after.FederationOK}
+	}
+	diff.Addrs = diffSets(before.DNSResult.Addrs, after.DNSResult.Addrs)
+	diff.CertFingerprints = diffSets(before.certFingerprints(), after.certFingerprints())
+	diff.Ciphers = diffSets(before.ciphers(), after.ciphers())
+	diff.KeyIDs = diffSets(before.keyIDs(), after.keyIDs())
+	diff.Changed = diff.FederationOK != nil || diff.Addrs.changed() || diff.CertFingerprints.changed() ||
+		diff.Ciphers.changed() || diff.KeyIDs.changed()
+	return diff
+}
+
+// certFingerprints returns the fingerprints of the leaf certificates served by each address.
+func (s *reportSnapshot) certFingerprints() []string {
+	var fingerprints []string
+	for _, connReport := range s.ConnectionReports {
+		if len(connReport.Certificates) > 0 {
+			fingerprints = append(fingerprints, connReport.Certificates[0].SHA256Fingerprint)
+		}
+	}
+	return fingerprints
+}
+
+// ciphers returns the "<version> <cipher suite>" negotiated by each address.
+func (s *reportSnapshot) ciphers() []string {
+	var ciphers []string
+	for _, connReport := range s.ConnectionReports {
+		ciphers = append(ciphers, connReport.Cipher.Version+" "+connReport.Cipher.CipherSuite)
+	}
+	return ciphers
+}
+
+// keyIDs returns the IDs of the verify_keys served by each address.
+func (s *reportSnapshot) keyIDs() []string {
+	var keyIDs []string
+	for _, connReport := range s.ConnectionReports {
+		var keys struct {
+			VerifyKeys map[string]json.RawMessage `json:"verify_keys"`
+		}
+		// The keys are null if they couldn't be fetched, which leaves VerifyKeys empty.
+		json.Unmarshal(connReport.Keys, &keys)
+		for keyID := range keys.VerifyKeys {
+			keyIDs = append(keyIDs, keyID)
+		}
+	}
+	return keyIDs
+}
+
+// diffSets returns the values added and removed between two lists, treating them as sets.
+func diffSets(before, after []string) SetDiff {
+	var diff SetDiff
+	diff.Added = subtractSet(after, before)
+	diff.Removed = subtractSet(before, after)
+	return diff
+}
+
+// subtractSet returns the sorted distinct values in a that aren't in b.
+func subtractSet(a, b []string) []string {
+	exclude := map[string]bool{}
+	for _, value := range b {
+		exclude[value] = true
+	}
+	var result []string
+	for _, value := range a {
+		if !exclude[value] {
+			exclude[value] = true
+			result = append(result, value)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// changed returns true if any values were added or removed.
+func (d SetDiff) changed() bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The go resolver doesn't expose the records it reads, so the supplementary
+// lookups that need them, like following CNAME chains, query the DNS server directly.
+
+// The time allowed for each supplementary DNS query.
+const dnsQueryTimeout = 5 * time.Second
+
+// The maximum number of CNAMEs followed before giving up on a chain.
+const maxCNAMEChainLength = 16
+
+// The largest DNS response we will read over UDP.
+const maxUDPResponseBytes = 4096
+
+// resolvConfPath is the file that the DNS server is read from.
+var resolvConfPath = "/etc/resolv.conf"
+
+// dnsServer is the "<ip>:<port>" of the DNS server to use instead of the system's, or empty to use the system's.
+// It can be set using the DNS_SERVER environment variable, see useDNSServer.
+var dnsServer string
+
+// useDNSServer sends all the DNS lookups the tester makes to the given "<ip>[:<port>]",
+// so that results can be compared across resolvers. The port defaults to 53.
+// This replaces net.DefaultResolver since matrixfederation.LookupServer uses it.
+func useDNSServer(addr string) error {
+	if net.ParseIP(addr) != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		return errors.New(host + " is not an IP address")
+	}
+	dnsServer = addr
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, dnsServer)
+		},
+	}
+	return nil
+}
+
+// dnsServerAddr returns the "<ip>:<port>" of the DNS server, which is dnsServer
+// if it is set, otherwise the first nameserver in resolv.conf, or the local host if there isn't one.
+func dnsServerAddr() string {
+	if dnsServer != "" {
+		return dnsServer
+	}
+	file, err := os.Open(resolvConfPath)
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// queryDNS sends a recursive query for the records of a type for a name to the DNS server.
+// The query is sent over UDP and retried over TCP if the response is truncated.
+func queryDNS(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	fqdn, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: fqdn, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+	response, err := exchangeDNS(ctx, "udp", packed, query.ID)
+	if err == nil && response.Truncated {
+		response, err = exchangeDNS(ctx, "tcp", packed, query.ID)
+	}
+	return response, err
+}
+
+// exchangeDNS sends a packed DNS query over the network and reads the response.
+// TCP messages are prefixed with their length.
+func exchangeDNS(ctx context.Context, network string, query []byte, id uint16) (*dnsmessage.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, dnsServerAddr())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	var raw []byte
+	if network == "tcp" {
+		raw, err = exchangeTCP(conn, query)
+	} else {
+		raw, err = exchangeUDP(conn, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var response dnsmessage.Message
+	if err = response.Unpack(raw); err != nil {
+		return nil, err
+	}
+	if response.ID != id {
+		return nil, errors.New("DNS response ID doesn't match the query")
+	}
+	return &response, nil
+}
+
+// exchangeUDP writes a DNS query as a single datagram and reads the response datagram.
+func exchangeUDP(conn net.Conn, query []byte) ([]byte, error) {
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, maxUDPResponseBytes)
+	n, err := conn.Read(buffer)
+	return buffer[:n], err
+}
+
+// exchangeTCP writes a length prefixed DNS query and reads the length prefixed response.
+func exchangeTCP(conn net.Conn, query []byte) ([]byte, error) {
+	message := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	copy(message[2:], query)
+	if _, err := conn.Write(message); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err := io.ReadFull(conn, response)
+	return response, err
+}
+
+// lookupCNAMEChain returns the CNAMEs followed when resolving a host, starting with the host itself.
+// Returns nil if the host isn't a CNAME, or is an IP address. Like
+// matrixfederation.LookupServer we ignore errors looking up CNAMEs since they
+// are only interesting for debugging.
+func lookupCNAMEChain(ctx context.Context, host string) []string {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	response, err := queryDNS(ctx, host, dnsmessage.TypeA)
+	if err != nil {
+		return nil
+	}
+	return cnameChain(host, response.Answers)
+}
+
+// lookupSRVTargetCNAMEs returns the CNAME chains of the SRV record targets that are CNAMEs, keyed by target.
+// Returns nil if none of them are.
+func lookupSRVTargetCNAMEs(ctx context.Context, records []*net.SRV) map[string][]string {
+	var chains map[string][]string
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		if _, ok := chains[target]; ok {
+			continue
+		}
+		if chain := lookupCNAMEChain(ctx, target); chain != nil {
+			if chains == nil {
+				chains = map[string][]string{}
+			}
+			chains[target] = chain
+		}
+	}
+	return chains
+}
+
+// cnameChain follows the CNAME records in a DNS answer from name.
+func cnameChain(name string, answers []dnsmessage.Resource) []string {
+	var chain []string
+	current := strings.TrimSuffix(name, ".")
+	for len(chain) < maxCNAMEChainLength {
+		target := ""
+		for _, answer := range answers {
+			cname, ok := answer.Body.(*dnsmessage.CNAMEResource)
+			if ok && strings.EqualFold(strings.TrimSuffix(answer.Header.Name.String(), "."), current) {
+				target = strings.TrimSuffix(cname.CNAME.String(), ".")
+				break
+			}
+		}
+		if target == "" {
+			break
+		}
+		if chain == nil {
+			chain = []string{current}
+		}
+		chain = append(chain, target)
+		current = target
+	}
+	return chain
+}
+
+// enhancedDNS controls whether the records found when resolving a server are queried
+// again directly so that their TTLs can be reported, see lookupDNSRecords.
+// The go resolver that matrixfederation.LookupServer uses doesn't expose the TTLs.
+// It can be set using the ENHANCED_DNS environment variable.
+var enhancedDNS bool
+
+// A DNSRecord is a record found when resolving a server, with its TTL.
+type DNSRecord struct {
+	Name       string // The name the record is for, without the trailing dot.
+	Type       string // The type of the record, "SRV", "CNAME", "A" or "AAAA".
+	Value      string // The data of the record, e.g. an IP address, or "<priority> <weight> <port> <target>" for SRV records.
+	TTLSeconds uint32 // The TTL returned by the DNS server, which for a caching resolver is how long until the record expires from its cache.
+}
+
+// lookupDNSRecords queries the DNS server directly for the SRV record of the server,
+// if it doesn't have an explicit port, and the A and AAAA records of the hosts that
+// were connected to, which are the SRV targets if there were any.
+// Returns the records with their TTLs, including any CNAMEs that were followed.
+// This is best effort, queries that fail are left out.
+func lookupDNSRecords(ctx context.Context, connectName string, srvRecords []*net.SRV) []DNSRecord {
+	host := hostOf(connectName)
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	var answers []dnsmessage.Resource
+	hosts := []string{host}
+	if !hasExplicitPort(connectName) {
+		answers = append(answers, queryAnswers(ctx, "_matrix._tcp."+host, dnsmessage.TypeSRV)...)
+		if len(srvRecords) > 0 {
+			hosts = nil
+			for _, record := range srvRecords {
+				if target := strings.TrimSuffix(record.Target, "."); !containsString(hosts, target) {
+					hosts = append(hosts, target)
+				}
+			}
+		}
+	}
+	for _, host := range hosts {
+		answers = append(answers, queryAnswers(ctx, host, dnsmessage.TypeA)...)
+		answers = append(answers, queryAnswers(ctx, host, dnsmessage.TypeAAAA)...)
+	}
+	return dnsRecords(answers)
+}
+
+// queryAnswers returns the answers to a DNS query, or nil if it failed.
+func queryAnswers(ctx context.Context, name string, qtype dnsmessage.Type) []dnsmessage.Resource {
+	response, err := queryDNS(ctx, name, qtype)
+	if err != nil {
+		return nil
+	}
+	return response.Answers
+}
+
+// dnsRecords converts DNS answers into DNSRecords, leaving out records of other
+// types and repeated records, like the CNAMEs in both the A and AAAA answers.
+func dnsRecords(answers []dnsmessage.Resource) []DNSRecord {
+	var records []DNSRecord
+	seen := map[DNSRecord]bool{}
+	for _, answer := range answers {
+		record := DNSRecord{Name: strings.TrimSuffix(answer.Header.Name.String(), ".")}
+		switch body := answer.Body.(type) {
+		case *dnsmessage.SRVResource:
+			record.Type = "SRV"
+			record.Value = fmt.Sprintf("%d %d %d %s", body.Priority, body.Weight, body.Port, strings.TrimSuffix(body.Target.String(), "."))
+		case *dnsmessage.CNAMEResource:
+			record.Type, record.Value = "CNAME", strings.TrimSuffix(body.CNAME.String(), ".")
+		case *dnsmessage.AResource:
+			record.Type, record.Value = "A", net.IP(body.A[:]).String()
+		case *dnsmessage.AAAAResource:
+			record.Type, record.Value = "AAAA", net.IP(body.AAAA[:]).String()
+		default:
+			continue
+		}
+		// Records are the same whatever TTL each query saw.
+		key := record
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		record.TTLSeconds = answer.Header.TTL
+		records = append(records, record)
+	}
+	return records
+}
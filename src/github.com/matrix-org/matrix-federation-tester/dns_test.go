@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/net/dns/dnsmessage"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testDNSResource(name string, ttl uint32, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	}
+}
+
+func TestDNSRecords(t *testing.T) {
+	answers := []dnsmessage.Resource{
+		testDNSResource("_matrix._tcp.example.com.", 3600, &dnsmessage.SRVResource{Priority: 10, Weight: 5, Port: 8448, Target: dnsmessage.MustNewName("matrix.example.com.")}),
+		testDNSResource("matrix.example.com.", 300, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("host.example.net.")}),
+		testDNSResource("host.example.net.", 60, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}),
+		// The CNAME is repeated in the answer to the AAAA query.
+		testDNSResource("matrix.example.com.", 299, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("host.example.net.")}),
+		testDNSResource("host.example.net.", 60, &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}),
+		testDNSResource("example.com.", 60, &dnsmessage.TXTResource{TXT: []string{"ignored"}}),
+	}
+	want := []DNSRecord{
+		{Name: "_matrix._tcp.example.com", Type: "SRV", Value: "10 5 8448 matrix.example.com", TTLSeconds: 3600},
+		{Name: "matrix.example.com", Type: "CNAME", Value: "host.example.net", TTLSeconds: 300},
+		{Name: "host.example.net", Type: "A", Value: "192.0.2.1", TTLSeconds: 60},
+		{Name: "host.example.net", Type: "AAAA", Value: "2001:db8::1", TTLSeconds: 60},
+	}
+	if got := dnsRecords(answers); !reflect.DeepEqual(got, want) {
+		t.Errorf("dnsRecords: want %#v got %#v", want, got)
+	}
+}
+
+func TestLookupDNSRecordsIPLiteral(t *testing.T) {
+	if records := lookupDNSRecords(context.Background(), "192.0.2.1:8448", nil); records != nil {
+		t.Errorf("lookupDNSRecords: want no records for an IP literal got %#v", records)
+	}
+}
+
+func TestDNSCacheRespectsRecordTTLs(t *testing.T) {
+	var cache dnsCache
+	now := time.Now()
+	cache.put("short.example.com", dnsCacheEntry{records: []DNSRecord{{TTLSeconds: 3600}, {TTLSeconds: 10}}, stored: now})
+	cache.put("plain.example.com", dnsCacheEntry{stored: now})
+	if _, ok := cache.get("short.example.com", now.Add(5*time.Second)); !ok {
+		t.Errorf("get: want the entry cached within the lowest record TTL")
+	}
+	if _, ok := cache.get("short.example.com", now.Add(10*time.Second)); ok {
+		t.Errorf("get: want the entry expired after the lowest record TTL")
+	}
+	if _, ok := cache.get("plain.example.com", now.Add(dnsCacheTTL-time.Second)); !ok {
+		t.Errorf("get: want an entry without records cached for dnsCacheTTL")
+	}
+	cache.put("zero.example.com", dnsCacheEntry{records: []DNSRecord{{TTLSeconds: 0}}, stored: now})
+	if _, ok := cache.get("zero.example.com", now); ok {
+		t.Errorf("get: want an entry with a zero TTL record not cached")
+	}
+}
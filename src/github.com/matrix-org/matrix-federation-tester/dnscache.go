@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/matrix-org/golang-matrixfederation"
+	"sync"
+	"time"
+)
+
+// dnsCacheTTL is the longest the result of looking up a server in DNS is cached for.
+// It can be set using the DNS_CACHE_TTL_SECONDS environment variable.
+// A TTL of zero disables the cache.
+// The go resolver doesn't tell us the TTLs of the records it reads, so unless ENHANCED_DNS
+// has found them, see entryTTL, the same TTL is used for every lookup.
+var dnsCacheTTL = 60 * time.Second
+
+// dnsResults is the cache of recent DNS lookups used by Report.
+var dnsResults dnsCache
+
+// A dnsCache holds the results of recent DNS lookups so that reports on the
+// same server don't look it up again. DNS changes much less often than the
+// TLS and key data that the report cache holds, so it is cached separately.
+// The entries are keyed by the name passed to matrixfederation.LookupServer.
+type dnsCache struct {
+	mutex     sync.Mutex
+	entries   map[string]dnsCacheEntry
+	lastSweep time.Time
+}
+
+// A dnsCacheEntry is the result of looking up a server in DNS.
+type dnsCacheEntry struct {
+	result          matrixfederation.DNSResult // The result of matrixfederation.LookupServer.
+	cnameChain      []string                   // The result of lookupCNAMEChain.
+	srvTargetCNAMEs map[string][]string        // The result of lookupSRVTargetCNAMEs.
+	records         []DNSRecord                // The result of lookupDNSRecords, if ENHANCED_DNS is set.
+	stored          time.Time                  // When the entry was added to the cache.
+	ttl             time.Duration              // How long the entry is cached for, set by put using entryTTL.
+}
+
+// get returns the cached entry for the name, or false if there isn't one younger than its TTL.
+func (c *dnsCache) get(name string, now time.Time) (dnsCacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[name]
+	if !ok {
+		return entry, false
+	}
+	if now.Sub(entry.stored) >= entry.ttl {
+		delete(c.entries, name)
+		return entry, false
+	}
+	entry.result = copyDNSResult(entry.result)
+	return entry, true
+}
+
+// put adds an entry to the cache for its entryTTL, unless that is zero.
+// Expired entries are swept out of the cache at most once per dnsCacheTTL.
+func (c *dnsCache) put(name string, entry dnsCacheEntry) {
+	entry.ttl = entryTTL(entry.records)
+	if entry.ttl <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]dnsCacheEntry{}
+	}
+	if entry.stored.Sub(c.lastSweep) >= dnsCacheTTL {
+		for key, old := range c.entries {
+			if entry.stored.Sub(old.stored) >= old.ttl {
+				delete(c.entries, key)
+			}
+		}
+		c.lastSweep = entry.stored
+	}
+	entry.result = copyDNSResult(entry.result)
+	c.entries[name] = entry
+}
+
+// entryTTL returns how long to cache a lookup for, which is the lowest TTL of the
+// records found by ENHANCED_DNS capped at dnsCacheTTL, or dnsCacheTTL if there aren't any.
+func entryTTL(records []DNSRecord) time.Duration {
+	ttl := dnsCacheTTL
+	for _, record := range records {
+		if recordTTL := time.Duration(record.TTLSeconds) * time.Second; recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	return ttl
+}
+
+// copyDNSResult returns a copy of a DNSResult that doesn't share its Hosts map,
+// since touchUpReport modifies the map of the report it is in.
+func copyDNSResult(result matrixfederation.DNSResult) matrixfederation.DNSResult {
+	hosts := make(map[string]matrixfederation.HostResult, len(result.Hosts))
+	for host, hostResult := range result.Hosts {
+		hosts[host] = hostResult
+	}
+	result.Hosts = hosts
+	return result
+}
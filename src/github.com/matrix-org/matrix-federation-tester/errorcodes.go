@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// The codes of the errors in a report, see ReportError.
+// These are part of the API so they mustn't be changed once added.
+const (
+	codeWellKnownFailed     = "WELL_KNOWN_FAILED"     // Fetching or parsing .well-known/matrix/server failed.
+	codeDNSNXDomain         = "DNS_NXDOMAIN"          // The name doesn't exist in DNS.
+	codeDNSTimeout          = "DNS_TIMEOUT"           // The DNS lookup timed out.
+	codeDNSFailed           = "DNS_FAILED"            // The DNS lookup failed for another reason, e.g. SERVFAIL.
+	codeConnectionFailed    = "CONNECTION_FAILED"     // The TCP connection couldn't be opened for another reason.
+	codeConnectionRefused   = "CONNECTION_REFUSED"    // The TCP connection was refused, so nothing is listening on the port.
+	codeHostUnreachable     = "HOST_UNREACHABLE"      // There is no route to the host or its network.
+	codeConnectionTimeout   = "CONNECTION_TIMEOUT"    // Connecting, the TLS handshake or the request timed out.
+	codeTLSHandshake        = "TLS_HANDSHAKE"         // The TLS handshake failed.
+	codeTLSCertExpired      = "TLS_CERT_EXPIRED"      // A certificate in the chain has expired or isn't valid yet.
+	codeTLSCertUntrusted    = "TLS_CERT_UNTRUSTED"    // The chain doesn't build to a trusted root.
+	codeTLSCertInvalid      = "TLS_CERT_INVALID"      // The chain failed to verify for another reason.
+	codeTLSClientCert       = "TLS_CLIENT_CERT"       // The server asked for a client certificate and failed the connection without one.
+	codeKeyFetchHTTP        = "KEY_FETCH_HTTP"        // The key request returned an HTTP status other than 200.
+	codeKeyFetchRedirect    = "KEY_FETCH_REDIRECT"    // The key request was redirected, which servers don't follow.
+	codeKeyFetchFailed      = "KEY_FETCH_FAILED"      // The key request failed after the TLS handshake.
+	codeKeyMalformed        = "KEY_MALFORMED"         // The key response wasn't a valid key document.
+	codeResponseTooLarge    = "RESPONSE_TOO_LARGE"    // The response was larger than MAX_RESPONSE_BYTES.
+	codeKeyInvalidSignature = "KEY_INVALID_SIGNATURE" // A signature on the keys couldn't be verified.
+	codeKeyChecksFailed     = "KEY_CHECKS_FAILED"     // The keys failed the checks, only used by /api/keys.
+	codeVersionFailed       = "VERSION_FAILED"        // Fetching the server version failed.
+	codeAddressNotProbed    = "ADDRESS_NOT_PROBED"    // The address wasn't probed because the server has too many.
+	codeAddressBlocked      = "ADDRESS_BLOCKED"       // The address wasn't probed because BLOCK_PRIVATE_ADDRESSES or ALLOWED_NETWORKS forbid it.
+)
+
+// errorCode returns the code of an error that was given one when it was produced, or empty if it wasn't.
+func errorCode(err error) string {
+	if stageErr, ok := err.(stageError); ok {
+		err = stageErr.Err
+	}
+	if reportErr, ok := err.(ReportError); ok {
+		return reportErr.Code
+	}
+	return ""
+}
+
+// isTimeout returns true if connecting to a server address or a request to it timed out,
+// including when there was no time left to try.
+func isTimeout(err error) bool {
+	return errorCode(err) == codeConnectionTimeout
+}
+
+// dnsErrorCode returns the code for an error looking up a name in DNS.
+func dnsErrorCode(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return codeDNSNXDomain
+	case errors.As(err, &dnsErr) && dnsErr.IsTimeout:
+		return codeDNSTimeout
+	}
+	return codeDNSFailed
+}
+
+// connectionErrorCode returns the code for an error probing a server address
+// that wasn't given a code when it was produced, based on the stage that failed.
+func connectionErrorCode(err error) string {
+	if err == errAddressNotProbed {
+		return codeAddressNotProbed
+	}
+	switch errorStage(err) {
+	case stageConnect:
+		return connectErrorCode(err)
+	case stageTLSHandshake:
+		return codeTLSHandshake
+	}
+	return codeKeyFetchFailed
+}
+
+// connectErrorCode returns the code for an error opening the TCP connection to a server address.
+// A refused connection means the port is closed while a timeout, which is given
+// CONNECTION_TIMEOUT by timeoutError, usually means a firewall is dropping the packets.
+func connectErrorCode(err error) string {
+	if stageErr, ok := err.(stageError); ok {
+		err = stageErr.Err
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return codeConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return codeHostUnreachable
+	}
+	return codeConnectionFailed
+}
+
+// chainErrorCode returns the code for an error verifying a certificate chain.
+func chainErrorCode(err error) string {
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	switch {
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return codeTLSCertExpired
+	case errors.As(err, &authorityErr):
+		return codeTLSCertUntrusted
+	}
+	return codeTLSCertInvalid
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"net"
+	"time"
+)
+
+// happyEyeballsDelay is how long a dual-stack client waits for an IPv6 connection before also trying IPv4.
+// This is the recommended Connection Attempt Delay from RFC 8305 section 5.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// A FamilySummary counts the server addresses of an address family and how many of them connected.
+type FamilySummary struct {
+	Addresses int // The number of server addresses in this family.
+	Connected int // The number of server addresses in this family that we connected to and fetched keys from.
+	// The fastest time taken to connect and complete the TLS handshake with an address in this family,
+	// or 0 if none of them connected.
+	FastestHandshakeMS float64
+}
+
+// addressFamily returns "IPv4" or "IPv6" for a "<ip>:<port>" address.
+func addressFamily(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// summarizeFamilies counts the server addresses in each address family and how many of them connected.
+// Also sets FirstSuccess and HappyEyeballsAddress.
+func (report *ServerReport) summarizeFamilies() {
+	report.AddressFamilies = map[string]FamilySummary{}
+	seen := map[string]bool{}
+	for _, addr := range report.DNSResult.Addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		family := addressFamily(addr)
+		summary := report.AddressFamilies[family]
+		summary.Addresses++
+		if _, ok := report.ConnectionReports[addr]; ok {
+			summary.Connected++
+			if handshake := handshakeMS(report.Timings.Addresses[addr]); summary.FastestHandshakeMS == 0 || handshake < summary.FastestHandshakeMS {
+				summary.FastestHandshakeMS = handshake
+			}
+		}
+		report.AddressFamilies[family] = summary
+	}
+	report.FirstSuccess, report.HappyEyeballsAddress = report.connectionOrder()
+}
+
+// handshakeMS returns the time taken to connect and complete the TLS handshake with an address.
+func handshakeMS(timings AddressTimings) float64 {
+	return timings.ConnectMS + timings.TLSHandshakeMS
+}
+
+// connectionOrder returns the address that returned keys first and the address
+// a dual-stack client following RFC 8305 would have used, out of the addresses that connected.
+// The client tries IPv6 first and only starts trying IPv4 after
+// happyEyeballsDelay, then uses whichever connection opened first.
+// All the addresses are probed at the same time so these are worked out from
+// the recorded timings, with ties going to the first address in sorted order.
+func (report *ServerReport) connectionOrder() (firstSuccess, happyEyeballs string) {
+	ipv4Delay := 0.0
+	if report.AddressFamilies["IPv6"].Addresses > 0 {
+		ipv4Delay = milliseconds(happyEyeballsDelay)
+	}
+	firstTime, happyTime := math.Inf(1), math.Inf(1)
+	for _, addr := range sortedAddrs(report.ConnectionReports) {
+		timings := report.Timings.Addresses[addr]
+		if total := handshakeMS(timings) + timings.RequestMS; total < firstTime {
+			firstSuccess, firstTime = addr, total
+		}
+		connected := timings.ConnectMS
+		if addressFamily(addr) == "IPv4" {
+			connected += ipv4Delay
+		}
+		if connected < happyTime {
+			happyEyeballs, happyTime = addr, connected
+		}
+	}
+	return firstSuccess, happyEyeballs
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/golang-matrixfederation"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A directResponse is a HTTP response read directly from a server address.
+type directResponse struct {
+	StatusCode int                 // The HTTP status code of the response.
+	Status     string              // The HTTP status line of the response, e.g. "200 OK".
+	Header     http.Header         // The HTTP headers of the response.
+	Body       []byte              // The body of the response.
+	ConnState  tls.ConnectionState // The state of the TLS connection used to make the request.
+	Timings    AddressTimings      // How long each stage of the request took.
+	// The server asked for a client certificate during the handshake, see clientCertRecorder.
+	ClientCertRequested bool
+}
+
+// AddressTimings records how long each stage of a request to a server address took.
+type AddressTimings struct {
+	ConnectMS      float64 // Milliseconds taken to open the TCP connection.
+	TLSHandshakeMS float64 // Milliseconds taken to complete the TLS handshake.
+	RequestMS      float64 // Milliseconds taken to send the HTTP request and read the response.
+	// Milliseconds taken to complete a second TLS handshake resuming the session
+	// of the first, only set if check_resumption was given and the session was resumed.
+	ResumedTLSHandshakeMS float64 `json:",omitempty"`
+}
+
+// milliseconds converts a duration into fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// The stages of generating a report that can fail.
+const (
+	stageDNS          = "dns"           // Looking up the server addresses in DNS.
+	stageConnect      = "connect"       // Opening the TCP connection.
+	stageTLSHandshake = "tls_handshake" // Completing the TLS handshake.
+	stageKeyFetch     = "key_fetch"     // Requesting and parsing the keys.
+	stageKeyChecks    = "key_checks"    // Checking the keys.
+)
+
+// A stageError is an error from one stage of probing a server address.
+type stageError struct {
+	Stage string // The stage that failed.
+	Err   error  // The error from that stage.
+}
+
+// Error implements the error interface.
+func (e stageError) Error() string {
+	return e.Err.Error()
+}
+
+// errorStage returns the stage a probe failed at, or stageKeyFetch if the error doesn't say.
+// This works for errors that have been touched up into ReportErrors too.
+func errorStage(err error) string {
+	if stageErr, ok := err.(stageError); ok {
+		return stageErr.Stage
+	}
+	if reportErr, ok := err.(ReportError); ok && reportErr.Stage != "" {
+		return reportErr.Stage
+	}
+	return stageKeyFetch
+}
+
+// fetchKeysDirect fetches the matrix keys directly from the given address.
+// This works like matrixfederation.FetchKeysDirect except that the dial, the
+// TLS handshake and the key request must all complete within the timeout.
+// If the timeout expires then a ReportError describing the timeout is returned.
+// Returns the keys and the response they were read from.
+func fetchKeysDirect(ctx context.Context, serverName, addr, sni string, timeout time.Duration) (*matrixfederation.ServerKeys, *directResponse, error) {
+	response, err := getDirect(ctx, serverName, addr, sni, "/_matrix/key/v2/server", timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.StatusCode >= 300 && response.StatusCode < 400 {
+		// Homeservers don't follow redirects when fetching keys so we don't either.
+		return nil, nil, stageError{stageKeyFetch, ReportError{Code: codeKeyFetchRedirect, Message: fmt.Sprintf(
+			"key server redirected with %d to %q, the key endpoint is redirecting which breaks federation since servers don't follow redirects when fetching keys",
+			response.StatusCode, response.Header.Get("Location"),
+		)}}
+	}
+	if response.StatusCode != 200 {
+		return nil, nil, stageError{stageKeyFetch, ReportError{Code: codeKeyFetchHTTP, Message: fmt.Sprintf(
+			"key server returned %d: %s", response.StatusCode, bodySnippet(response.Body),
+		)}}
+	}
+	keys := matrixfederation.ServerKeys{Raw: response.Body}
+	if err = json.Unmarshal(keys.Raw, &keys); err != nil {
+		return nil, nil, stageError{stageKeyFetch, ReportError{Code: codeKeyMalformed, Message: err.Error()}}
+	}
+	return &keys, response, nil
+}
+
+// isJSONContentType returns true if a Content-Type header is application/json, with or without parameters like charset.
+// Servers don't check the Content-Type of key responses but stricter clients may,
+// and a proxy serving the keys as something else is often serving a cached or rewritten response.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+// The maximum number of bytes of a response body included in an error message.
+const maxSnippetBytes = 200
+
+// bodySnippet returns the start of a response body for including in an error message.
+// Whitespace is collapsed so that the snippet fits on one line.
+func bodySnippet(body []byte) string {
+	truncated := len(body) > maxSnippetBytes
+	if truncated {
+		body = body[:maxSnippetBytes]
+	}
+	snippet := strings.Join(strings.Fields(strings.ToValidUTF8(string(body), "")), " ")
+	if truncated {
+		snippet += "..."
+	}
+	return snippet
+}
+
+// dialTimeout is the time allowed for opening the TCP connection, or 0 to only use the overall timeout.
+// It can be set using the DIAL_TIMEOUT_SECONDS environment variable.
+var dialTimeout time.Duration
+
+// tlsHandshakeTimeout is the time allowed for the TLS handshake, or 0 to only use the overall timeout.
+// It can be set using the TLS_HANDSHAKE_TIMEOUT_SECONDS environment variable.
+var tlsHandshakeTimeout time.Duration
+
+// minTLSVersion is the lowest TLS version we will negotiate, or 0 for the go default.
+// It can be set using the MIN_TLS_VERSION environment variable. Lowering it
+// below the go default is only intended for diagnosing legacy servers.
+var minTLSVersion uint16
+
+// minTLSVersions maps the values of MIN_TLS_VERSION to TLS versions.
+var minTLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// getDirect makes a GET request for path directly to the given address over TLS.
+// The serverName is used as the Host header. Optionally sets a SNI header if sni is not empty.
+// The whole request must complete within the timeout, and the dial and the
+// TLS handshake must complete within dialTimeout and tlsHandshakeTimeout if they are set.
+// Errors are returned as stageErrors recording which stage of the request failed.
+// If a timeout expires then the error is a ReportError describing the timeout.
+// If the context is cancelled then the error is errReportCancelled.
+func getDirect(ctx context.Context, serverName, addr, sni, path string, timeout time.Duration) (*directResponse, error) {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	config, clientCertRequested := clientCertRecorder(tlsConfig(sni))
+	tlsconn, connected, err := dialTLSConfig(ctx, addr, config, start, deadline)
+	if err != nil {
+		return nil, clientCertError(ctx, err, *clientCertRequested)
+	}
+	defer tlsconn.Close()
+	handshaken := time.Now()
+	// The rest of the overall timeout covers the request.
+	if err = tlsconn.SetDeadline(deadline); err != nil {
+		return nil, stageError{stageConnect, err}
+	}
+	// Abort the request if the context is cancelled.
+	stop := context.AfterFunc(ctx, func() { tlsconn.SetDeadline(time.Now()) })
+	defer stop()
+
+	response, err := requestDirect(serverName, path, tlsconn)
+	if err != nil {
+		// With TLS 1.3 the server only rejects the missing client certificate after
+		// the client has finished the handshake, so it fails the request instead.
+		err = stageError{stageKeyFetch, cancelledError(ctx, timeoutError(classifyError(stageKeyFetch, err), timeout))}
+		return nil, clientCertError(ctx, err, *clientCertRequested)
+	}
+	response.ClientCertRequested = *clientCertRequested
+	response.Timings = AddressTimings{
+		ConnectMS:      milliseconds(connected.Sub(start)),
+		TLSHandshakeMS: milliseconds(handshaken.Sub(connected)),
+		RequestMS:      milliseconds(time.Since(handshaken)),
+	}
+	return response, nil
+}
+
+// dialTLS opens a TLS connection to the given address, sending sni as the SNI if it is not empty.
+// The dial and the handshake must complete before the deadline, and within
+// dialTimeout and tlsHandshakeTimeout if they are set.
+// Returns the connection and the time the TCP connection was opened.
+func dialTLS(ctx context.Context, addr, sni string, start, deadline time.Time) (*tls.Conn, time.Time, error) {
+	return dialTLSConfig(ctx, addr, tlsConfig(sni), start, deadline)
+}
+
+// tlsConfig returns the TLS config for connecting to a server address, sending sni as the SNI if it is not empty.
+func tlsConfig(sni string) *tls.Config {
+	return &tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true, // The matrix keys are used to check the certificate rather than a CA.
+		MinVersion:         minTLSVersion,
+	}
+}
+
+// dialTLSConfig opens a TLS connection to the given address like dialTLS but using the given TLS config.
+func dialTLSConfig(ctx context.Context, addr string, config *tls.Config, start, deadline time.Time) (*tls.Conn, time.Time, error) {
+	dialDeadline := earliest(deadline, start, dialTimeout)
+	dialer := net.Dialer{Deadline: dialDeadline}
+	tcpconn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		err = timeoutError(classifyError(stageConnect, err), dialDeadline.Sub(start))
+		return nil, time.Time{}, stageError{stageConnect, cancelledError(ctx, err)}
+	}
+	connected := time.Now()
+	handshakeDeadline := earliest(deadline, connected, tlsHandshakeTimeout)
+	if err = tcpconn.SetDeadline(handshakeDeadline); err != nil {
+		tcpconn.Close()
+		return nil, time.Time{}, stageError{stageConnect, err}
+	}
+	tlsconn := tls.Client(tcpconn, config)
+	if err = tlsconn.HandshakeContext(ctx); err != nil {
+		tcpconn.Close()
+		err = timeoutError(classifyError(stageTLSHandshake, err), handshakeDeadline.Sub(start))
+		return nil, time.Time{}, stageError{stageTLSHandshake, cancelledError(ctx, err)}
+	}
+	return tlsconn, connected, nil
+}
+
+// clientCertRecorder returns a copy of a TLS config that records whether the server asks
+// for a client certificate, which a reverse proxy on the federation port mustn't do since
+// servers don't send one. We don't have one to send, so we send an empty certificate.
+// The bool pointed to is set when the server asks.
+func clientCertRecorder(config *tls.Config) (*tls.Config, *bool) {
+	requested := new(bool)
+	config = config.Clone()
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		*requested = true
+		return &tls.Certificate{}, nil
+	}
+	return config, requested
+}
+
+// clientCertError replaces an error connecting to a server address that asked for a client
+// certificate with a ReportError explaining that, since the server most likely failed the
+// connection because we didn't send one. Errors from the connect stage and cancellations are left alone.
+func clientCertError(ctx context.Context, err error, requested bool) error {
+	if !requested || err == errReportCancelled || ctx.Err() != nil || errorStage(err) == stageConnect {
+		return err
+	}
+	return stageError{stageTLSHandshake, ReportError{
+		Code:    codeTLSClientCert,
+		Message: "TLS handshake failed: the server requires a client certificate, which federating servers don't send. Turn off client certificate verification on the federation port, e.g. ssl_verify_client in nginx",
+		Raw:     err.Error(),
+	}}
+}
+
+// earliest returns the earlier of the deadline and the time the timeout after now.
+// A timeout of 0 means there's no timeout other than the deadline.
+func earliest(deadline, now time.Time, timeout time.Duration) time.Time {
+	if timeout > 0 && now.Add(timeout).Before(deadline) {
+		return now.Add(timeout)
+	}
+	return deadline
+}
+
+// timeoutError replaces a network timeout with a ReportError saying how long we waited.
+func timeoutError(err error, waited time.Duration) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ReportError{Code: codeConnectionTimeout, Message: fmt.Sprintf("connection timed out after %v", waited.Round(time.Millisecond))}
+	}
+	return err
+}
+
+// cancelledError replaces err with errReportCancelled if it was caused by the context being cancelled.
+func cancelledError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return errReportCancelled
+	}
+	return err
+}
+
+// requestDirect writes a GET request for path down a TLS connection and reads the response.
+func requestDirect(serverName, path string, tlsconn *tls.Conn) (*directResponse, error) {
+	// Write the GET request down the connection.
+	requestURL := "matrix://" + serverName + path
+	request, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Connection", "close")
+	request.Header.Set("User-Agent", userAgent)
+	if err = request.Write(tlsconn); err != nil {
+		return nil, err
+	}
+
+	// Read the response from the server.
+	response, err := http.ReadResponse(bufio.NewReader(tlsconn), request)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := directResponse{
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+		Header:     response.Header,
+		ConnState:  tlsconn.ConnectionState(),
+	}
+	if result.Body, err = readLimited(response.Body, maxResponseBytes); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// maxResponseBytes is the largest response body we will read from a server address,
+// so that a broken or malicious server can't make us use lots of memory.
+// It can be set using the MAX_RESPONSE_BYTES environment variable.
+var maxResponseBytes int64 = 256 * 1024
+
+// readLimited reads a response body, returning a ReportError if it is longer than limit bytes.
+func readLimited(body io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ReportError{Code: codeResponseTooLarge, Message: fmt.Sprintf(
+			"the response is larger than the limit of %d bytes", limit,
+		)}
+	}
+	return data, nil
+}
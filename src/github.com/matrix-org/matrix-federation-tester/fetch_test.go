@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchKeysRedirect(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "https://matrix.example.com/_matrix/key/v2/server", 302)
+	}))
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+	_, _, err := fetchKeysDirect(context.Background(), "example.com", addr, "example.com", 5*time.Second)
+	if err == nil {
+		t.Fatalf("fetchKeysDirect(%q): want an error got nil", addr)
+	}
+	if code := errorCode(err); code != codeKeyFetchRedirect {
+		t.Errorf("fetchKeysDirect(%q): want code %q got %q", addr, codeKeyFetchRedirect, code)
+	}
+	if want := "https://matrix.example.com/_matrix/key/v2/server"; !strings.Contains(err.Error(), want) {
+		t.Errorf("fetchKeysDirect(%q): want an error containing %q got %q", addr, want, err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"github.com/matrix-org/golang-matrixfederation"
+)
+
+// A FingerprintMismatch records the fingerprints when the certificate served doesn't match the keys.
+type FingerprintMismatch struct {
+	Expected []matrixfederation.Base64String // The SHA256 fingerprints listed in the tls_fingerprints of the keys.
+	Actual   matrixfederation.Base64String   // The SHA256 fingerprint of the leaf certificate served.
+}
+
+// checkFingerprint compares the leaf certificate's fingerprint with the tls_fingerprints in the keys.
+// Returns whether one of them matched, and the fingerprints if the keys list some but none of them matched.
+func checkFingerprint(keys matrixfederation.ServerKeys, certs []X509CertSummary) (bool, *FingerprintMismatch) {
+	if len(keys.TLSFingerprints) == 0 || len(certs) == 0 {
+		return false, nil
+	}
+	actual := certs[0].SHA256Fingerprint
+	var expected []matrixfederation.Base64String
+	for _, fingerprint := range keys.TLSFingerprints {
+		if bytes.Equal(fingerprint.SHA256, actual) {
+			return true, nil
+		}
+		expected = append(expected, fingerprint.SHA256)
+	}
+	return false, &FingerprintMismatch{Expected: expected, Actual: actual}
+}
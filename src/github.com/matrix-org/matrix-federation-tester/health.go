@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// readinessLookupName is the name looked up in DNS to check that the tester is ready.
+// It can be set using the READINESS_LOOKUP_NAME environment variable.
+var readinessLookupName = "matrix.org"
+
+// The time allowed for the readiness DNS lookup.
+const readinessTimeout = 5 * time.Second
+
+// HandleHealthz handles a liveness probe. It does no network I/O.
+// GET /healthz request.
+func HandleHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintln(w, "OK")
+}
+
+// HandleReadyz handles a readiness probe by checking that we can resolve a known name in DNS.
+// GET /readyz request.
+func HandleReadyz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	ctx, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+	defer cancel()
+	if _, err := net.DefaultResolver.LookupHost(ctx, readinessLookupName); err != nil {
+		w.WriteHeader(503)
+		fmt.Fprintf(w, "Cannot resolve %q: %v\n", readinessLookupName, err)
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprintln(w, "OK")
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/golang-matrixfederation"
+	"golang.org/x/crypto/ed25519"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The server name and key ID of the keys served by a fakeHomeserver.
+const (
+	fakeServerName = "example.com"
+	fakeKeyID      = "ed25519:fake"
+)
+
+// A fakeHomeserver describes an in-process matrix server that serves a key
+// document for fakeServerName. The zero value serves valid keys signed by
+// the published key, with a certificate that hasn't expired.
+type fakeHomeserver struct {
+	certExpired    bool // Serve a certificate that expired a day ago.
+	badSignature   bool // Sign the keys with a different key to the one published in verify_keys.
+	noFingerprints bool // Leave the deprecated tls_fingerprints out of the keys.
+	keyStatus      int  // The status code of the key response, or 0 for 200.
+	keyPadding     int  // The number of spaces to pad the key response with.
+
+	v2Status     int           // The status code of the v2 federation probe, or 0 for 401.
+	v2Errcode    string        // The errcode of the v2 federation probe response, or empty for M_UNAUTHORIZED.
+	keyDelay     time.Duration // How long to wait before responding to the key request.
+	versionDelay time.Duration // How long to wait before responding to the version request and the v2 federation probe.
+
+	clientAuth    tls.ClientAuthType // Whether to ask for a client certificate during the handshake.
+	maxTLSVersion uint16             // The highest TLS version to negotiate, or 0 for the go default.
+}
+
+// start starts the fake server, which is closed when the test finishes.
+// Returns its "<ip>:<port>" and the leaf certificate it serves.
+func (fake fakeHomeserver) start(t *testing.T) (string, *x509.Certificate) {
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(30 * 24 * time.Hour)
+	if fake.certExpired {
+		notAfter = time.Now().Add(-24 * time.Hour)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: fakeServerName},
+		DNSNames:     []string{fakeServerName},
+		NotBefore:    time.Now().Add(-30 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, certKey.Public(), certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := fake.signedKeys(t, der)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/_matrix/key/v2/server":
+			if fake.keyStatus != 0 && fake.keyStatus != 200 {
+				w.WriteHeader(fake.keyStatus)
+				return
+			}
+			time.Sleep(fake.keyDelay)
+			w.Write(keys)
+			w.Write(bytes.Repeat([]byte(" "), fake.keyPadding))
+		case "/_matrix/federation/v1/version":
+			time.Sleep(fake.versionDelay)
+			w.Write([]byte(`{"server": {"name": "Fake", "version": "1.0"}}`))
+		case "/_matrix/federation/v2/send_join/!probe:example.com/$probe":
+			time.Sleep(fake.versionDelay)
+			status, errcode := fake.v2Status, fake.v2Errcode
+			if status == 0 {
+				status = 401
+			}
+			if errcode == "" {
+				errcode = "M_UNAUTHORIZED"
+			}
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"errcode": %q}`, errcode)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: certKey}},
+		ClientAuth:   fake.clientAuth,
+		MaxVersion:   fake.maxTLSVersion,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String(), cert
+}
+
+// signedKeys returns the key document served by the fake server, with the
+// fingerprint of the certificate it serves.
+func (fake fakeHomeserver) signedKeys(t *testing.T, certDER []byte) []byte {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.badSignature {
+		if _, privateKey, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fingerprint := sha256.Sum256(certDER)
+	keys := map[string]interface{}{
+		"server_name":      fakeServerName,
+		"valid_until_ts":   time.Now().Add(7*24*time.Hour).UnixNano() / int64(time.Millisecond),
+		"verify_keys":      map[string]interface{}{fakeKeyID: map[string]interface{}{"key": matrixfederation.Base64String(publicKey)}},
+		"tls_fingerprints": []interface{}{map[string]interface{}{"sha256": matrixfederation.Base64String(fingerprint[:])}},
+	}
+	if fake.noFingerprints {
+		delete(keys, "tls_fingerprints")
+	}
+	unsigned, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := matrixfederation.SignJSON(fakeServerName, fakeKeyID, privateKey, unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// fakeReport generates a report on fakeServerName that connects to the fake server at addr.
+func fakeReport(t *testing.T, addr string) *ServerReport {
+	report, err := reportWithOptions(context.Background(), fakeServerName, "", 5*time.Second, reportOptions{targetAddr: addr})
+	if err != nil {
+		t.Fatalf("reportWithOptions(%q): %v", addr, err)
+	}
+	return report
+}
+
+// fakeConnectionReport generates a report on the fake server and returns the report for its address.
+func fakeConnectionReport(t *testing.T, fake fakeHomeserver) (ConnectionReport, *x509.Certificate) {
+	addr, cert := fake.start(t)
+	report := fakeReport(t, addr)
+	connReport, ok := report.ConnectionReports[addr]
+	if !ok {
+		t.Fatalf("report for %q: want a connection report got error %v", addr, report.ConnectionErrors[addr])
+	}
+	return connReport, cert
+}
+
+func TestFakeHomeserverValidKeys(t *testing.T) {
+	connReport, cert := fakeConnectionReport(t, fakeHomeserver{})
+	if !connReport.Checks.AllChecksOK {
+		t.Errorf("Checks: want all checks OK got %#v", connReport.Checks)
+	}
+	if !connReport.FingerprintMatch || !connReport.ChecksSummary[checkMatchingTLSFingerprint] {
+		t.Errorf("FingerprintMatch, ChecksSummary[%q]: want true got %v, %v", checkMatchingTLSFingerprint, connReport.FingerprintMatch, connReport.ChecksSummary[checkMatchingTLSFingerprint])
+	}
+	if _, ok := connReport.ChecksSummary["fingerprint_match"]; ok || len(connReport.ChecksSummary) != len(summarizeChecks(connReport.Checks)) {
+		t.Errorf("ChecksSummary: want only the summarized key checks got %v", connReport.ChecksSummary)
+	}
+	if check := connReport.SignatureChecks[fakeKeyID]; !check.Verified {
+		t.Errorf("SignatureChecks[%q]: want verified got %#v", fakeKeyID, check)
+	}
+	if connReport.KeyExpired || connReport.ClockSkewSuspected {
+		t.Errorf("KeyExpired, ClockSkewSuspected: want false got %v, %v", connReport.KeyExpired, connReport.ClockSkewSuspected)
+	}
+	if len(connReport.Certificates) != 1 {
+		t.Fatalf("Certificates: want 1 got %d", len(connReport.Certificates))
+	}
+	summary := connReport.Certificates[0]
+	if summary.SubjectCommonName != fakeServerName || summary.Expired || !summary.NotAfter.Equal(cert.NotAfter) {
+		t.Errorf("Certificates[0]: want an unexpired certificate for %q expiring %v got %#v", fakeServerName, cert.NotAfter, summary)
+	}
+	if !connReport.CoversServerName {
+		t.Errorf("CoversServerName: want true got false")
+	}
+	if connReport.Version.Name != "Fake" || connReport.Version.Version != "1.0" {
+		t.Errorf("Version: want Fake 1.0 got %#v", connReport.Version)
+	}
+	if supported := connReport.Version.SupportsFederationV2; supported == nil || !*supported {
+		t.Errorf("Version.SupportsFederationV2: want true got %v", supported)
+	}
+}
+
+func TestFakeHomeserverExpiredCert(t *testing.T) {
+	connReport, _ := fakeConnectionReport(t, fakeHomeserver{certExpired: true})
+	if len(connReport.Certificates) != 1 {
+		t.Fatalf("Certificates: want 1 got %d", len(connReport.Certificates))
+	}
+	if summary := connReport.Certificates[0]; !summary.Expired || summary.DaysUntilExpiry >= 0 {
+		t.Errorf("Certificates[0]: want an expired certificate got %#v", summary)
+	}
+}
+
+func TestFakeHomeserverBadSignature(t *testing.T) {
+	connReport, _ := fakeConnectionReport(t, fakeHomeserver{badSignature: true})
+	if connReport.Checks.AllChecksOK {
+		t.Errorf("Checks: want the checks to fail got all checks OK")
+	}
+	if check := connReport.SignatureChecks[fakeKeyID]; check.Verified || check.Error == nil {
+		t.Errorf("SignatureChecks[%q]: want an unverified signature got %#v", fakeKeyID, check)
+	}
+}
+
+func TestFakeHomeserverKeyStatus(t *testing.T) {
+	addr, _ := fakeHomeserver{keyStatus: 404}.start(t)
+	report := fakeReport(t, addr)
+	err, ok := report.ConnectionErrors[addr]
+	if !ok {
+		t.Fatalf("ConnectionErrors[%q]: want an error got none", addr)
+	}
+	if code := errorCode(err); code != codeKeyFetchHTTP {
+		t.Errorf("ConnectionErrors[%q]: want code %q got %q", addr, codeKeyFetchHTTP, code)
+	}
+	if report.FederationOK {
+		t.Errorf("FederationOK: want false got true")
+	}
+}
+
+func TestFakeHomeserverCABundle(t *testing.T) {
+	fake := fakeHomeserver{}
+	addr, cert := fake.start(t)
+	connReport := fakeReport(t, addr).ConnectionReports[addr]
+	if connReport.ChainVerified == nil || *connReport.ChainVerified || connReport.TrustStore != trustStoreSystem {
+		t.Errorf("ChainVerified, TrustStore: want false, %q got %v, %q", trustStoreSystem, connReport.ChainVerified, connReport.TrustStore)
+	}
+	caBundleRoots = x509.NewCertPool()
+	caBundleRoots.AddCert(cert)
+	defer func() { caBundleRoots = nil }()
+	connReport = fakeReport(t, addr).ConnectionReports[addr]
+	if connReport.ChainVerified == nil || !*connReport.ChainVerified || connReport.TrustStore != trustStoreCABundle {
+		t.Errorf("ChainVerified, TrustStore: want true, %q got %v, %q (%v)", trustStoreCABundle, connReport.ChainVerified, connReport.TrustStore, connReport.ChainError)
+	}
+}
+
+func TestFakeHomeserverSNIList(t *testing.T) {
+	addr, _ := fakeHomeserver{}.start(t)
+	request := ReportRequest{ServerName: fakeServerName, TLSSNI: "example.com, other.example.com,example.com", TargetAddr: addr}
+	if err := request.validate(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := reportWithOptions(context.Background(), request.ServerName, request.sni(), 5*time.Second, request.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := report.ConnectionReports[addr].SNIResults
+	if len(results) != 2 {
+		t.Fatalf("SNIResults: want 2 results got %#v", results)
+	}
+	if result := results["example.com"]; !result.CoversSNI || !result.SameAsFirstSNI {
+		t.Errorf("SNIResults[%q]: want a certificate covering it got %#v", "example.com", result)
+	}
+	if result := results["other.example.com"]; result.Error != nil || result.CoversSNI || !result.SameAsFirstSNI {
+		t.Errorf("SNIResults[%q]: want the same certificate not covering it got %#v", "other.example.com", result)
+	}
+}
+
+func TestParseSNIsLimit(t *testing.T) {
+	if _, err := parseSNIs("a,b,c,d,e,f"); err == nil {
+		t.Errorf("parseSNIs: want an error for more than %d values got nil", maxSNIValues)
+	}
+}
+
+func TestFakeHomeserverAt(t *testing.T) {
+	addr, _ := fakeHomeserver{}.start(t)
+	at := time.Now().Add(60 * 24 * time.Hour).UTC()
+	request := ReportRequest{ServerName: fakeServerName, TargetAddr: addr, At: at.Format(time.RFC3339)}
+	if err := request.validate(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := reportWithOptions(context.Background(), request.ServerName, request.sni(), 5*time.Second, request.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.CheckedAt.Equal(at.Truncate(time.Second)) || report.GeneratedAt.After(time.Now()) {
+		t.Errorf("CheckedAt, GeneratedAt: want %v, now got %v, %v", at, report.CheckedAt, report.GeneratedAt)
+	}
+	connReport := report.ConnectionReports[addr]
+	if !connReport.KeyExpired || !connReport.Certificates[0].Expired || report.FederationOK {
+		t.Errorf("KeyExpired, Expired, FederationOK: want true, true, false got %v, %v, %v", connReport.KeyExpired, connReport.Certificates[0].Expired, report.FederationOK)
+	}
+}
+
+func TestFakeHomeserverSharedDeadline(t *testing.T) {
+	// The version request fits in the timeout but the v2 probe after it doesn't.
+	addr, _ := fakeHomeserver{versionDelay: 600 * time.Millisecond}.start(t)
+	report, err := reportWithOptions(context.Background(), fakeServerName, "", time.Second, reportOptions{targetAddr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connReport, ok := report.ConnectionReports[addr]
+	if !ok {
+		t.Fatalf("ConnectionReports: want a report for %s got errors %v", addr, report.ConnectionErrors)
+	}
+	if connReport.Version.Error != nil {
+		t.Errorf("Version: want no error got %v", connReport.Version.Error)
+	}
+	if connReport.Version.SupportsFederationV2 != nil {
+		t.Errorf("SupportsFederationV2: want nil since the probe ran out of time got %v", *connReport.Version.SupportsFederationV2)
+	}
+}
+
+func TestFakeHomeserverSlowKeys(t *testing.T) {
+	// The keys take half the timeout, so the resumption check and the version request,
+	// which both wait for the version endpoint, run out of time.
+	addr, _ := fakeHomeserver{keyDelay: 500 * time.Millisecond, versionDelay: 600 * time.Millisecond}.start(t)
+	report, err := reportWithOptions(context.Background(), fakeServerName, "", time.Second, reportOptions{targetAddr: addr, checkResumption: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connReport, ok := report.ConnectionReports[addr]
+	if !ok {
+		t.Fatalf("ConnectionReports: want a report for %s got errors %v", addr, report.ConnectionErrors)
+	}
+	if connReport.SNIRequired == nil || *connReport.SNIRequired {
+		t.Errorf("SNIRequired: want false since the handshake fit in the timeout got %v", connReport.SNIRequired)
+	}
+	if connReport.SessionResumed != nil {
+		t.Errorf("SessionResumed: want nil since the check ran out of time got %v", *connReport.SessionResumed)
+	}
+	if !connReport.Version.TimedOut {
+		t.Errorf("Version: want TimedOut got %v", connReport.Version.Error)
+	}
+	if outcome := reportOutcome(report, nil); outcome != outcomeOK {
+		t.Errorf("reportOutcome: want %q got %q", outcomeOK, outcome)
+	}
+	for _, factor := range report.ScoreFactors {
+		if factor.Name == "version" && factor.Points != factor.MaxPoints {
+			t.Errorf("ScoreFactors: want full points for the version got %v", factor)
+		}
+	}
+}
+
+func TestFakeHomeserverNoTimeLeft(t *testing.T) {
+	addr, _ := fakeHomeserver{}.start(t)
+	if required := sniRequired(context.Background(), addr, &tls.ConnectionState{}, 0); required != nil {
+		t.Errorf("sniRequired: want nil with no time left got %v", *required)
+	}
+	if resumed, _ := checkResumption(context.Background(), fakeServerName, addr, fakeServerName, 0); resumed != nil {
+		t.Errorf("checkResumption: want nil with no time left got %v", *resumed)
+	}
+	if version := fetchVersionDirect(context.Background(), fakeServerName, addr, fakeServerName, 0); !version.TimedOut {
+		t.Errorf("fetchVersionDirect: want TimedOut with no time left got %v", version.Error)
+	}
+}
+
+// scoreFactorPoints returns the points scored for a factor of a report's score.
+func scoreFactorPoints(report *ServerReport, name string) int {
+	for _, factor := range report.ScoreFactors {
+		if factor.Name == name {
+			return factor.Points
+		}
+	}
+	return -1
+}
+
+func TestFakeHomeserverScoreKeysSkippedChecks(t *testing.T) {
+	addr, _ := fakeHomeserver{noFingerprints: true}.start(t)
+	report := fakeReport(t, addr)
+	if points := scoreFactorPoints(report, "keys"); points != 0 {
+		t.Errorf("keys score without tls_fingerprints: want 0 got %d", points)
+	}
+	report, err := reportWithOptions(context.Background(), fakeServerName, "", 5*time.Second, reportOptions{targetAddr: addr, skipChecks: []string{"tls_fingerprint"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points := scoreFactorPoints(report, "keys"); points != 25 {
+		t.Errorf("keys score skipping tls_fingerprint: want 25 got %d", points)
+	}
+}
+
+func testFederationV2(t *testing.T, fake fakeHomeserver, want *bool) {
+	addr, _ := fake.start(t)
+	got := probeFederationV2(context.Background(), fakeServerName, addr, fakeServerName, 5*time.Second)
+	if (got == nil) != (want == nil) || (got != nil && *got != *want) {
+		t.Errorf("probeFederationV2 for %d %s: want %v got %v", fake.v2Status, fake.v2Errcode, formatBoolPointer(want), formatBoolPointer(got))
+	}
+}
+
+// formatBoolPointer formats a *bool as "true", "false" or "nil".
+func formatBoolPointer(value *bool) string {
+	if value == nil {
+		return "nil"
+	}
+	return fmt.Sprint(*value)
+}
+
+func TestFederationV2Probe(t *testing.T) {
+	supported, unsupported := true, false
+	testFederationV2(t, fakeHomeserver{}, &supported)
+	testFederationV2(t, fakeHomeserver{v2Status: 405, v2Errcode: "M_UNRECOGNIZED"}, &supported)
+	testFederationV2(t, fakeHomeserver{v2Status: 404, v2Errcode: "M_NOT_FOUND"}, &unsupported)
+	testFederationV2(t, fakeHomeserver{v2Status: 400, v2Errcode: "M_UNRECOGNIZED"}, &unsupported)
+	// A proxy that answers 400 to any unknown path doesn't say whether the server supports v2.
+	testFederationV2(t, fakeHomeserver{v2Status: 400, v2Errcode: "M_BAD_REQUEST"}, nil)
+}
+
+func TestWellKnownLookupTimeout(t *testing.T) {
+	// A host that accepts connections but never answers the TLS handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	start := time.Now()
+	result := lookupWellKnown(context.Background(), listener.Addr().String(), 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("lookupWellKnown: want it to stop after the timeout got %v", elapsed)
+	}
+	if result.Error == nil || !strings.Contains(result.Error.Error(), "timed out after 200ms") {
+		t.Errorf("lookupWellKnown: want a timeout error got %v", result.Error)
+	}
+}
+
+func TestParseReportRequestTimeoutTooLong(t *testing.T) {
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/report?server_name=example.com&timeout=%d", maxTimeoutSeconds), nil)
+	if _, err := parseReportRequest(req); err != nil {
+		t.Errorf("parseReportRequest: want no error for the longest timeout got %v", err)
+	}
+	req = httptest.NewRequest("GET", fmt.Sprintf("/api/report?server_name=example.com&timeout=%d", maxTimeoutSeconds+1), nil)
+	if _, err := parseReportRequest(req); err == nil {
+		t.Errorf("parseReportRequest: want an error for a timeout over the limit got nil")
+	}
+}
+
+func TestParseReportRequestInvalidAt(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/report?server_name=example.com&at=next+week", nil)
+	if _, err := parseReportRequest(req); err == nil {
+		t.Errorf("parseReportRequest: want an error for a malformed at got nil")
+	}
+	req = httptest.NewRequest("GET", "/api/report?server_name=example.com&at=2030-01-02T03:04:05%2B01:00", nil)
+	request, err := parseReportRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.At != "2030-01-02T02:04:05Z" {
+		t.Errorf("At: want %q got %q", "2030-01-02T02:04:05Z", request.At)
+	}
+}
+
+func TestFakeHomeserverStrict(t *testing.T) {
+	addr, cert := fakeHomeserver{}.start(t)
+	report := fakeReport(t, addr)
+	connReport := report.ConnectionReports[addr]
+	if want := []string{strictTrustedChain}; !report.FederationOK || report.StrictFederationOK || !reflect.DeepEqual(connReport.StrictFailures, want) {
+		t.Errorf("FederationOK, StrictFederationOK, StrictFailures: want true, false, %q got %v, %v, %q", want, report.FederationOK, report.StrictFederationOK, connReport.StrictFailures)
+	}
+	caBundleRoots = x509.NewCertPool()
+	caBundleRoots.AddCert(cert)
+	defer func() { caBundleRoots = nil }()
+	report = fakeReport(t, addr)
+	if connReport = report.ConnectionReports[addr]; !report.StrictFederationOK || len(connReport.StrictFailures) != 0 {
+		t.Errorf("StrictFederationOK, StrictFailures: want true, [] got %v, %q", report.StrictFederationOK, connReport.StrictFailures)
+	}
+}
+
+func TestFakeHomeserverStrictExpiredCert(t *testing.T) {
+	fake := fakeHomeserver{certExpired: true}
+	connReport, _ := fakeConnectionReport(t, fake)
+	if !containsString(connReport.StrictFailures, strictNotExpired) {
+		t.Errorf("StrictFailures: want %q got %q", strictNotExpired, connReport.StrictFailures)
+	}
+}
+
+func TestFakeHomeserverOversizedKeys(t *testing.T) {
+	addr, _ := fakeHomeserver{keyPadding: int(maxResponseBytes)}.start(t)
+	report := fakeReport(t, addr)
+	if code := errorCode(report.ConnectionErrors[addr]); code != codeResponseTooLarge {
+		t.Errorf("ConnectionErrors[%q]: want code %q got %q (%v)", addr, codeResponseTooLarge, code, report.ConnectionErrors[addr])
+	}
+}
+
+func testVerdict(t *testing.T, query string, wantCode int, wantBody string) {
+	recorder := httptest.NewRecorder()
+	HandleVerdict(recorder, httptest.NewRequest("GET", "/api/verdict?"+query, nil))
+	if recorder.Code != wantCode || recorder.Body.String() != wantBody {
+		t.Errorf("/api/verdict?%s: want %d %q got %d %q", query, wantCode, wantBody, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestFakeHomeserverVerdict(t *testing.T) {
+	addr, _ := fakeHomeserver{}.start(t)
+	testVerdict(t, "no_cache=1&server_name="+fakeServerName+"&target_addr="+addr, 200, "OK\n")
+	testVerdict(t, "no_cache=1&format=bogus&server_name="+fakeServerName+"&target_addr="+addr, 200, "OK\n")
+	addr, _ = fakeHomeserver{badSignature: true}.start(t)
+	testVerdict(t, "no_cache=1&server_name="+fakeServerName+"&target_addr="+addr, 503, "FAIL\n")
+	testVerdict(t, "server_name=", 400, "ERROR: Missing server_name\n")
+}
+
+func TestVerdictPreflight(t *testing.T) {
+	testPreflight(t, HandleVerdict, "/api/verdict")
+}
+
+func testFakeHomeserverClientCertRequired(t *testing.T, maxTLSVersion uint16) {
+	addr, _ := fakeHomeserver{clientAuth: tls.RequireAndVerifyClientCert, maxTLSVersion: maxTLSVersion}.start(t)
+	err := fakeReport(t, addr).ConnectionErrors[addr]
+	if code := errorCode(err); code != codeTLSClientCert || errorStage(err) != stageTLSHandshake {
+		t.Errorf("ConnectionErrors[%q] with TLS version %x: want code %q at stage %q got %q at stage %q (%v)", addr, maxTLSVersion, codeTLSClientCert, stageTLSHandshake, code, errorStage(err), err)
+	}
+}
+
+func TestFakeHomeserverClientCertRequired(t *testing.T) {
+	testFakeHomeserverClientCertRequired(t, tls.VersionTLS12)
+	testFakeHomeserverClientCertRequired(t, tls.VersionTLS13)
+}
+
+func TestFakeHomeserverClientCertRequested(t *testing.T) {
+	connReport, _ := fakeConnectionReport(t, fakeHomeserver{clientAuth: tls.RequestClientCert})
+	if !connReport.ClientCertRequested {
+		t.Errorf("ClientCertRequested: want true got false")
+	}
+	connReport, _ = fakeConnectionReport(t, fakeHomeserver{})
+	if connReport.ClientCertRequested {
+		t.Errorf("ClientCertRequested: want false got true")
+	}
+}
+
+// A fakeLegacyReport is the part of a legacyReport that the tests check.
+type fakeLegacyReport struct {
+	FederationOK      bool
+	DNSResult         struct{ Addrs []string }
+	ConnectionReports map[string]struct {
+		Checks       struct{ AllChecksOK, ValidCertificates bool }
+		Certificates []struct{ SubjectCommonName string }
+		Errors       []interface{}
+	}
+	Version struct {
+		Name string `json:"name"`
+	}
+}
+
+// legacyFakeReport probes a fake server and returns its report in the legacy format, and the JSON encoding.
+func legacyFakeReport(t *testing.T, addr string) (fakeLegacyReport, []byte) {
+	report := fakeReport(t, addr)
+	report.touchUpReport()
+	encoded, err := encodeJSON(toLegacyReport(report), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var legacy fakeLegacyReport
+	if err = json.Unmarshal(encoded, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	return legacy, encoded
+}
+
+func TestFakeHomeserverLegacyFormat(t *testing.T) {
+	addr, cert := fakeHomeserver{}.start(t)
+	caBundleRoots = x509.NewCertPool()
+	caBundleRoots.AddCert(cert)
+	defer func() { caBundleRoots = nil }()
+	legacy, encoded := legacyFakeReport(t, addr)
+	connReport, ok := legacy.ConnectionReports[addr]
+	if !legacy.FederationOK || !ok || !connReport.Checks.AllChecksOK || !connReport.Checks.ValidCertificates || connReport.Errors == nil {
+		t.Fatalf("legacy report: want FederationOK and a passing report for %q got %s", addr, encoded)
+	}
+	if len(connReport.Certificates) != 1 || connReport.Certificates[0].SubjectCommonName != fakeServerName || legacy.Version.Name != "Fake" {
+		t.Errorf("Certificates, Version: want %q, %q got %s", fakeServerName, "Fake", encoded)
+	}
+}
+
+func TestFakeHomeserverLegacyFormatUntrustedCert(t *testing.T) {
+	addr, _ := fakeHomeserver{}.start(t)
+	legacy, encoded := legacyFakeReport(t, addr)
+	connReport := legacy.ConnectionReports[addr]
+	if legacy.FederationOK || connReport.Checks.AllChecksOK || connReport.Checks.ValidCertificates {
+		t.Errorf("legacy report: want a failing report for a self-signed certificate got %s", encoded)
+	}
+}
+
+func TestFakeHomeserverLegacyFormatIgnoresFingerprints(t *testing.T) {
+	addr, cert := fakeHomeserver{noFingerprints: true}.start(t)
+	caBundleRoots = x509.NewCertPool()
+	caBundleRoots.AddCert(cert)
+	defer func() { caBundleRoots = nil }()
+	if report := fakeReport(t, addr); report.FederationOK {
+		t.Fatalf("FederationOK: want false without tls_fingerprints got true")
+	}
+	legacy, encoded := legacyFakeReport(t, addr)
+	if !legacy.FederationOK || !legacy.ConnectionReports[addr].Checks.AllChecksOK {
+		t.Errorf("legacy report: want FederationOK without tls_fingerprints got %s", encoded)
+	}
+}
+
+func TestKeyCheckCacheReusesIdenticalKeys(t *testing.T) {
+	addr, _ := fakeHomeserver{}.start(t)
+	otherAddr, _ := fakeHomeserver{}.start(t)
+	var cache keyCheckCache
+	now := time.Now()
+	check := func(addr string) (keyCheckResult, bool) {
+		keys, response, err := fetchKeysDirect(context.Background(), fakeServerName, addr, fakeServerName, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache.check(fakeServerName, now, *keys, &response.ConnState)
+	}
+	first, reused := check(addr)
+	if reused || !first.checks.AllChecksOK {
+		t.Fatalf("check(%q): want fresh passing checks got reused %v, %#v", addr, reused, first.checks)
+	}
+	first.signatureChecks[fakeKeyID] = SignatureCheck{}
+	second, reused := check(addr)
+	if !reused || !second.checks.AllChecksOK || !second.signatureChecks[fakeKeyID].Verified {
+		t.Errorf("check(%q) again: want the unchanged checks reused got reused %v, %#v", addr, reused, second.signatureChecks)
+	}
+	// The other server has its own certificate and signing key, so its keys are different.
+	if _, reused = check(otherAddr); reused {
+		t.Errorf("check(%q): want fresh checks for different keys got reused", otherAddr)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// An htmlReportPage is the data rendered by reportTemplate.
+// Either Report or Error is set.
+type htmlReportPage struct {
+	ServerName string        // The server name that was asked for.
+	Report     *ServerReport // The report on the server.
+	Error      string        // Why the report couldn't be generated.
+}
+
+// reportTemplate renders a report as a standalone HTML page.
+// html/template escapes everything taken from the report, which includes
+// strings controlled by the server being tested such as certificate names.
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"status": func(ok bool) string {
+		if ok {
+			return "pass"
+		}
+		return "fail"
+	},
+	"gradeStatus": func(grade string) string {
+		if isWeakGrade(grade) {
+			return "fail"
+		}
+		return "pass"
+	},
+	"expiryStatus": func(days int) string {
+		if days < 0 {
+			return "fail"
+		}
+		if days < 30 {
+			return "warn"
+		}
+		return "pass"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Federation report for {{.ServerName}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+.pass { color: #1a7f37; }
+.warn { color: #9a6700; }
+.fail { color: #cf222e; }
+</style>
+</head>
+<body>
+<h1>Federation report for {{.ServerName}}</h1>
+{{if .Error}}
+<p class="fail">{{.Error}}</p>
+{{else}}{{with .Report}}
+<p class="{{status .FederationOK}}"><strong>{{if .FederationOK}}Federation OK{{else}}Federation failed{{end}}</strong>: {{.Summary}}</p>
+<p>Score: {{.Score}}/100. Generated at {{.GeneratedAt.UTC.Format "2006-01-02T15:04:05Z"}}{{if .Cached}} (cached){{end}}.</p>
+{{if .Warnings}}
+<h2>Warnings</h2>
+<ul>{{range .Warnings}}
+<li class="warn">{{.Message}}</li>{{end}}
+</ul>
+{{end}}
+{{range .Addresses}}
+<h2>{{.Address}}</h2>
+{{if .Error}}
+<p class="fail">Connection failed: {{.Error}}</p>
+{{else}}{{with .Report}}
+<table>
+<tr><th>TLS</th><td class="{{gradeStatus .Cipher.Grade}}">{{.Cipher.Version}} {{.Cipher.CipherSuite}} ({{.Cipher.Grade}})</td></tr>
+<tr><th>Keys</th><td class="{{status .Checks.AllChecksOK}}">{{if .Checks.AllChecksOK}}All checks OK{{else}}Failed {{range $i, $check := .FailedChecks}}{{if $i}}, {{end}}{{$check}}{{end}}{{end}}</td></tr>
+<tr><th>Keys valid until</th><td class="{{status (not .ClockSkewSuspected)}}">{{.KeyValidUntil.UTC.Format "2006-01-02T15:04:05Z"}}</td></tr>
+<tr><th>Version</th>{{if .Version.Error}}<td class="fail">{{.Version.Error}}</td>{{else}}<td>{{.Version.Name}} {{.Version.Version}}</td>{{end}}</tr>
+</table>
+<table>
+<tr><th>Certificate</th><th>Subject</th><th>Issuer</th><th>Expires</th></tr>
+{{range .Certificates}}<tr><td>{{.ChainIndex}}</td><td>{{.SubjectCommonName}}</td><td>{{.IssuerCommonName}}</td><td class="{{expiryStatus .DaysUntilExpiry}}">{{.NotAfter.UTC.Format "2006-01-02"}} ({{.DaysUntilExpiry}} days)</td></tr>
+{{end}}</table>
+{{end}}{{end}}
+{{end}}{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// HandleHTMLReport handles an HTTP request for a report rendered as an HTML page,
+// for people who want to look at a report in a browser.
+// GET /report?server_name=matrix.org&tls_sni=whatever&timeout=10&no_cache=1 request.
+// Takes the same query parameters as /api/report, other than format which is ignored.
+func HandleHTMLReport(w http.ResponseWriter, req *http.Request) {
+	setCORSHeaders(w, "GET")
+	if req.Method == "OPTIONS" {
+		return
+	}
+	rlog := newRequestLog()
+	defer rlog.write()
+	w.Header().Set("X-Request-ID", rlog.ID)
+	if req.Method != "GET" {
+		rlog.Outcome = "unsupported method"
+		writeHTMLReport(w, 405, htmlReportPage{Error: fmt.Sprintf("Unsupported method %q", req.Method)})
+		return
+	}
+	request, err := parseFormatlessReportRequest(req)
+	if err != nil {
+		rlog.Outcome = "bad request: " + err.Error()
+		writeHTMLReport(w, 400, htmlReportPage{Error: err.Error()})
+		return
+	}
+	rlog.ServerName, rlog.TLSSNI = request.ServerName, request.TLSSNI
+	report, err := cachedReport(req.Context(), *request)
+	if err == errReportCancelled {
+		rlog.Outcome = "cancelled"
+		return
+	}
+	if err != nil {
+		rlog.Outcome = "error: " + err.Error()
+		writeHTMLReport(w, reportErrorStatus(w, err, 500), htmlReportPage{ServerName: request.ServerName, Error: err.Error()})
+		return
+	}
+	rlog.Addrs = report.DNSResult.Addrs
+	rlog.Outcome = report.Summary
+	setCacheHeaders(w, report, time.Now())
+	writeHTMLReport(w, 200, htmlReportPage{ServerName: request.ServerName, Report: report})
+}
+
+// writeHTMLReport renders a page with reportTemplate.
+// The Content-Security-Policy stops the page loading anything or running scripts,
+// as a second line of defence if anything from the report were ever left unescaped.
+func writeHTMLReport(w http.ResponseWriter, code int, page htmlReportPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	if page.Error != "" {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	w.WriteHeader(code)
+	reportTemplate.Execute(w, page)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTMLReportEscapesServerStrings(t *testing.T) {
+	report := &ServerReport{
+		ConnectionReports: map[string]ConnectionReport{"1.2.3.4:8448": {
+			Certificates: []X509CertSummary{{SubjectCommonName: "<script>alert(1)</script>"}},
+			Version:      VersionReport{Name: `"><img src=x>`},
+		}},
+		ConnectionErrors: map[string]error{"5.6.7.8:8448": errors.New("<b>refused</b>")},
+	}
+	report.touchUpReport()
+	recorder := httptest.NewRecorder()
+	writeHTMLReport(recorder, 200, htmlReportPage{ServerName: "<i>example.com</i>", Report: report})
+	body := recorder.Body.String()
+	for _, unescaped := range []string{"<script>", "<img", "<b>", "<i>"} {
+		if strings.Contains(body, unescaped) {
+			t.Errorf("writeHTMLReport: want %q to be escaped got %s", unescaped, body)
+		}
+	}
+	for _, want := range []string{"1.2.3.4:8448", "5.6.7.8:8448", "&lt;script&gt;"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("writeHTMLReport: want %q in the page got %s", want, body)
+		}
+	}
+}
+
+// testPreflight checks that an endpoint answers a CORS preflight request for GET.
+func testPreflight(t *testing.T, handler http.HandlerFunc, path string) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("OPTIONS", path, nil))
+	if recorder.Code != 200 || recorder.Header().Get("Access-Control-Allow-Origin") != "*" || recorder.Header().Get("Access-Control-Allow-Methods") != "GET, OPTIONS" {
+		t.Errorf("OPTIONS %s: want 200 with CORS headers got %d %v", path, recorder.Code, recorder.Header())
+	}
+}
+
+func TestHTMLReportPreflight(t *testing.T) {
+	testPreflight(t, HandleHTMLReport, "/report")
+}
+
+func TestHTMLReportIgnoresFormat(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	HandleHTMLReport(recorder, httptest.NewRequest("GET", "/report?format=bogus&server_name=", nil))
+	if body := recorder.Body.String(); recorder.Code != 400 || !strings.Contains(body, "Missing server_name") {
+		t.Errorf("/report?format=bogus&server_name=: want 400 for the missing server_name got %d %s", recorder.Code, body)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// maxInFlightRequests is the maximum number of reports that are generated at once across all clients.
+// It can be set using the MAX_IN_FLIGHT_REQUESTS environment variable.
+// A maximum of zero disables the limit.
+var maxInFlightRequests = 100
+
+// inFlightRetryAfter is the Retry-After sent when there are too many reports in flight, in seconds.
+// Reports normally finish within the connection timeout so a slot should be free by then.
+const inFlightRetryAfter = 5
+
+// inFlight holds a token for each report that is being generated, see acquireReportSlot.
+// It is created by configureFromEnv since its size depends on maxInFlightRequests.
+var inFlight chan struct{}
+
+// errTooManyReports is returned instead of a report when maxInFlightRequests are already being generated.
+var errTooManyReports = fmt.Errorf("Too many reports in progress, try again in %d seconds", inFlightRetryAfter)
+
+// acquireReportSlot takes one of the maxInFlightRequests slots for generating a report,
+// returning false rather than waiting if they are all taken, so that a flood of requests
+// can't exhaust the memory or sockets of the process. Each report in a batch or diff
+// takes its own slot. This is separate from rateLimited which limits each client.
+// The slot must be given back with releaseReportSlot.
+func acquireReportSlot() bool {
+	if inFlight == nil {
+		return true
+	}
+	select {
+	case inFlight <- struct{}{}:
+		inFlightGauge.Inc()
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseReportSlot gives back a slot taken by acquireReportSlot.
+func releaseReportSlot() {
+	if inFlight == nil {
+		return
+	}
+	inFlightGauge.Dec()
+	<-inFlight
+}
+
+// reportErrorStatus returns the HTTP status code for an error generating a report.
+// If there were too many reports in progress then it's a 503 with a Retry-After header.
+func reportErrorStatus(w http.ResponseWriter, err error, status int) int {
+	if err == errTooManyReports {
+		w.Header().Set("Retry-After", strconv.Itoa(inFlightRetryAfter))
+		return 503
+	}
+	return status
+}
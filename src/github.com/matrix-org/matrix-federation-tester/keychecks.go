@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"github.com/matrix-org/golang-matrixfederation"
+	"sync"
+	"time"
+)
+
+// A keyCheckCache shares the results of checking the keys between the addresses
+// probed for a single report. Servers with many addresses in front of the same
+// backend return byte-identical key documents, so the signatures only need to be
+// verified once. The results also depend on the leaf certificate, since the keys
+// are checked against its fingerprint, so entries are keyed by both.
+type keyCheckCache struct {
+	mutex   sync.Mutex
+	entries map[keyCheckKey]*keyCheckEntry
+}
+
+// A keyCheckKey is the SHA-256 hashes of a raw key document and the leaf certificate it was served with.
+type keyCheckKey struct {
+	keys [sha256.Size]byte
+	leaf [sha256.Size]byte
+}
+
+// A keyCheckEntry is the result of checking a key document, which is computed once by the first address to need it.
+type keyCheckEntry struct {
+	once   sync.Once
+	result keyCheckResult
+}
+
+// A keyCheckResult is the result of checking a key document served by an address.
+type keyCheckResult struct {
+	checks            matrixfederation.KeyChecks               // The result of matrixfederation.CheckKeys.
+	ed25519VerifyKeys map[string]matrixfederation.Base64String // The verify keys returned by matrixfederation.CheckKeys.
+	fingerprints      []matrixfederation.Base64String          // The TLS fingerprints returned by matrixfederation.CheckKeys.
+	signatureChecks   map[string]SignatureCheck                // The result of checkSignatures.
+}
+
+// check checks the keys served over a connection, reusing the result for an identical
+// key document and leaf certificate if another address has already checked them.
+// Returns whether the result was reused. Concurrent calls for the same keys wait for the first.
+func (c *keyCheckCache) check(serverName string, now time.Time, keys matrixfederation.ServerKeys, connState *tls.ConnectionState) (keyCheckResult, bool) {
+	key := keyCheckKey{keys: sha256.Sum256(keys.Raw)}
+	if len(connState.PeerCertificates) > 0 {
+		key.leaf = sha256.Sum256(connState.PeerCertificates[0].Raw)
+	}
+	c.mutex.Lock()
+	if c.entries == nil {
+		c.entries = map[keyCheckKey]*keyCheckEntry{}
+	}
+	entry, reused := c.entries[key]
+	if !reused {
+		entry = &keyCheckEntry{}
+		c.entries[key] = entry
+	}
+	c.mutex.Unlock()
+	entry.once.Do(func() {
+		entry.result.checks, entry.result.ed25519VerifyKeys, entry.result.fingerprints = matrixfederation.CheckKeys(serverName, now, keys, connState)
+		entry.result.signatureChecks = checkSignatures(keys)
+	})
+	return entry.result.copy(), reused
+}
+
+// copy returns a copy of the result whose maps can be changed without changing the cached result,
+// since the errors in the connection reports are touched up in place.
+func (r keyCheckResult) copy() keyCheckResult {
+	if r.signatureChecks != nil {
+		signatureChecks := make(map[string]SignatureCheck, len(r.signatureChecks))
+		for keyID, check := range r.signatureChecks {
+			signatureChecks[keyID] = check
+		}
+		r.signatureChecks = signatureChecks
+	}
+	return r
+}
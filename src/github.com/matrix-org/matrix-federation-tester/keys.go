@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/golang-matrixfederation"
+	"net/http"
+	"time"
+)
+
+// A KeysResponse is the validated verify keys of a matrix server.
+type KeysResponse struct {
+	ServerName string                                   // The name of the matrix server.
+	Address    string                                   // The "<ip>:<port>" the keys were fetched from.
+	VerifyKeys map[string]matrixfederation.Base64String // The ed25519 verify keys by key ID.
+	ValidUntil time.Time                                // When the keys need to be fetched again.
+}
+
+// HandleKeys handles an HTTP request for just the validated verify keys of a matrix server.
+// GET /api/keys?server_name=matrix.org request.
+// Responds with a JSON KeysResponse if keys that passed all the checks were fetched
+// from one of the server's addresses, or a 502 with an ErrorResponse if not.
+// This skips everything in a full report that isn't needed to validate the keys.
+func HandleKeys(w http.ResponseWriter, req *http.Request) {
+	setCORSHeaders(w, "GET")
+	if req.Method == "OPTIONS" {
+		return
+	}
+	if req.Method != "GET" {
+		writeJSONError(w, 405, fmt.Errorf("Unsupported method %q", req.Method))
+		return
+	}
+	serverName, err := normalizeServerName(req.URL.Query().Get("server_name"))
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	if !acquireReportSlot() {
+		writeJSONError(w, reportErrorStatus(w, errTooManyReports, 500), errTooManyReports)
+		return
+	}
+	defer releaseReportSlot()
+	response, err := validatedKeys(req.Context(), serverName, connectionTimeout)
+	if err == errReportCancelled {
+		// The client has gone away so there's no one to send a response to.
+		return
+	}
+	if err != nil {
+		writeJSONError(w, 502, err)
+		return
+	}
+	encoded, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(encoded)
+}
+
+// validatedKeys resolves a matrix server and fetches its keys from each of its
+// addresses in turn until one returns keys that pass all the checks.
+// If none do then the error from the first address is returned.
+func validatedKeys(ctx context.Context, serverName string, timeout time.Duration) (*KeysResponse, error) {
+	var report ServerReport
+	connectName, err := report.resolve(ctx, serverName, timeout, false)
+	if err != nil {
+		return nil, err
+	}
+	addrs := report.DNSResult.Addrs
+	if len(addrs) == 0 {
+		return nil, ReportError{Code: codeDNSFailed, Message: "No addresses were found for the server in DNS"}
+	}
+	if len(addrs) > maxProbedAddresses {
+		addrs = addrs[:maxProbedAddresses]
+	}
+	var firstErr error
+	for _, addr := range addrs {
+		response, err := fetchValidatedKeys(ctx, serverName, connectName, addr, timeout)
+		if ctx.Err() != nil {
+			return nil, errReportCancelled
+		}
+		if err == nil {
+			return response, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// fetchValidatedKeys fetches the keys from a single address and checks them.
+// Addresses blocked by checkAddress aren't connected to.
+func fetchValidatedKeys(ctx context.Context, serverName, connectName, addr string, timeout time.Duration) (*KeysResponse, error) {
+	if err := checkAddress(addr); err != nil {
+		return nil, err
+	}
+	keys, response, err := fetchKeysDirect(ctx, connectName, addr, hostOf(connectName), timeout)
+	if err != nil {
+		reportErr := toReportError(err, connectionErrorCode(err))
+		reportErr.Message = fmt.Sprintf("Fetching the keys from %s failed: %s", addr, reportErr.Message)
+		return nil, reportErr
+	}
+	checks, verifyKeys, _ := matrixfederation.CheckKeys(serverName, time.Now(), *keys, &response.ConnState)
+	if failed := failedChecks(checks, nil); len(failed) > 0 {
+		return nil, ReportError{Code: codeKeyChecksFailed, Message: fmt.Sprintf("The keys from %s failed the checks %v", addr, failed)}
+	}
+	return &KeysResponse{
+		ServerName: serverName,
+		Address:    addr,
+		VerifyKeys: verifyKeys,
+		ValidUntil: time.Unix(0, keys.ValidUntilTS*int64(time.Millisecond)).UTC(),
+	}, nil
+}
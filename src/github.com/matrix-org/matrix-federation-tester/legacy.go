@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/golang-matrixfederation"
+)
+
+// A legacyReport is a report in the shape returned by the reference federation
+// tester at federationtester.matrix.org, so that its web UI can be pointed at
+// this tester. It is returned for format=legacy, see toLegacyReport.
+type legacyReport struct {
+	WellKnownResult   legacyWellKnownResult             // The .well-known delegation.
+	DNSResult         legacyDNSResult                   // The result of looking up the server in DNS.
+	ConnectionReports map[string]legacyConnectionReport // The report for each server address we could connect to.
+	ConnectionErrors  map[string]error                  // The errors for each server address we couldn't connect to.
+	Version           legacyVersion                     // The server implementation advertised by the first address that connected.
+	FederationOK      bool                              // Did at least one address connect with every connected address passing the legacyChecksOK checks?
+}
+
+// A legacyWellKnownResult is the .well-known delegation in a legacyReport.
+type legacyWellKnownResult struct {
+	ServerAddress string `json:"m.server"`         // The delegated server address, or empty if there wasn't one.
+	Result        string `json:"result,omitempty"` // Why the .well-known lookup failed, if it did.
+}
+
+// A legacyDNSResult is a DNS result in a legacyReport, which also says whether SRV records were looked up.
+type legacyDNSResult struct {
+	matrixfederation.DNSResult
+	SRVSkipped bool // The server had an explicit port or a target_addr was given, so SRV records weren't looked up.
+}
+
+// A legacyConnectionReport is the report on a server address in a legacyReport.
+type legacyConnectionReport struct {
+	Certificates      []legacyCertificate                      // The certificates served, leaf first.
+	Cipher            legacyCipher                             // The TLS version and cipher suite negotiated.
+	Checks            legacyKeyChecks                          // The checks applied to the keys and their results.
+	Errors            []error                                  // Always empty since problems are reported as checks or connection errors.
+	Ed25519VerifyKeys map[string]matrixfederation.Base64String // The verify keys for this server or nil if the checks were not ok.
+	Keys              *json.RawMessage                         // The server key JSON returned by this server.
+}
+
+// A legacyCertificate is a certificate in a legacyConnectionReport.
+type legacyCertificate struct {
+	SubjectCommonName string                        // The common name of the subject.
+	IssuerCommonName  string                        // The common name of the issuer.
+	SHA256Fingerprint matrixfederation.Base64String // The SHA256 fingerprint of the certificate.
+	DNSNames          []string                      // The DNS names this certificate is valid for.
+}
+
+// A legacyCipher is the TLS version and cipher suite in a legacyConnectionReport.
+type legacyCipher struct {
+	Version     string // The TLS version, e.g. "TLS 1.3".
+	CipherSuite string // The name of the cipher suite.
+}
+
+// legacyKeyChecks are the key checks in a legacyConnectionReport, which also say whether the certificate is valid.
+type legacyKeyChecks struct {
+	matrixfederation.KeyChecks
+	ValidCertificates bool // The certificate chain verified and the leaf certificate covers the TLS SNI sent.
+}
+
+// A legacyVersion is the server implementation in a legacyReport.
+type legacyVersion struct {
+	Name    string `json:"name"`            // The name of the server implementation.
+	Version string `json:"version"`         // The version of the server implementation.
+	Error   string `json:"error,omitempty"` // Why the version couldn't be fetched, if it couldn't.
+}
+
+// toLegacyReport converts a touched up report into a legacyReport.
+// Fields that the reference tester doesn't have are left out.
+// FederationOK is computed from the legacyChecksOK of each connection rather than copied,
+// since the native verdict also requires the tls_fingerprints to match.
+func toLegacyReport(report *ServerReport) legacyReport {
+	legacy := legacyReport{
+		DNSResult:         legacyDNSResult{report.DNSResult, report.ExplicitPort || report.ResolutionSkipped},
+		ConnectionReports: map[string]legacyConnectionReport{},
+		ConnectionErrors:  report.ConnectionErrors,
+	}
+	if report.WellKnownResult != nil {
+		legacy.WellKnownResult.ServerAddress = report.WellKnownResult.ServerAddress
+		if report.WellKnownResult.Error != nil {
+			legacy.WellKnownResult.Result = report.WellKnownResult.Error.Error()
+		}
+	}
+	versionSet := false
+	for _, result := range report.Addresses {
+		if result.Report == nil {
+			continue
+		}
+		legacy.ConnectionReports[result.Address] = toLegacyConnectionReport(*result.Report)
+		if !versionSet {
+			legacy.Version = legacyVersion{Name: result.Report.Version.Name, Version: result.Report.Version.Version}
+			if result.Report.Version.Error != nil {
+				legacy.Version.Error = result.Report.Version.Error.Error()
+			}
+			versionSet = true
+		}
+	}
+	legacy.FederationOK = len(legacy.ConnectionReports) > 0
+	for _, connReport := range legacy.ConnectionReports {
+		if !connReport.Checks.AllChecksOK {
+			legacy.FederationOK = false
+		}
+	}
+	return legacy
+}
+
+// toLegacyConnectionReport converts the report on a server address into a legacyConnectionReport.
+func toLegacyConnectionReport(connReport ConnectionReport) legacyConnectionReport {
+	legacy := legacyConnectionReport{
+		Cipher:            legacyCipher{connReport.Cipher.Version, connReport.Cipher.CipherSuite},
+		Checks:            legacyKeyChecks{connReport.Checks, isTrue(connReport.ChainVerified) && connReport.CoversServerName},
+		Errors:            []error{},
+		Ed25519VerifyKeys: connReport.Ed25519VerifyKeys,
+		Keys:              connReport.Keys,
+	}
+	legacy.Checks.AllChecksOK = legacyChecksOK(legacy.Checks)
+	for _, cert := range connReport.Certificates {
+		legacy.Certificates = append(legacy.Certificates, legacyCertificate{
+			SubjectCommonName: cert.SubjectCommonName,
+			IssuerCommonName:  cert.IssuerCommonName,
+			SHA256Fingerprint: cert.SHA256Fingerprint,
+			DNSNames:          cert.DNSNames,
+		})
+	}
+	return legacy
+}
+
+// legacyChecksOK returns whether a connection passes the checks the reference tester
+// uses for AllChecksOK: the certificates are valid and the server_name, valid_until_ts
+// and ed25519 verdictChecks pass. Unlike matrixfederation.KeyChecks.AllChecksOK it
+// doesn't check the deprecated tls_fingerprints, which the reference tester ignores.
+func legacyChecksOK(checks legacyKeyChecks) bool {
+	if !checks.ValidCertificates {
+		return false
+	}
+	for _, name := range []string{"server_name", "valid_until_ts", "ed25519"} {
+		if !verdictChecks[name](checks.KeyChecks) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+// A requestLog collects the details of a report request so that they can be
+// logged as a single line when the request completes.
+type requestLog struct {
+	ID         string    // The request ID returned to the client in the X-Request-ID header.
+	Start      time.Time // When the request started.
+	ServerName string    // The requested server name.
+	TLSSNI     string    // The requested TLS SNI.
+	Addrs      []string  // The addresses the server name resolved to.
+	Outcome    string    // The outcome of the request.
+}
+
+// newRequestLog starts a requestLog with a new random request ID.
+func newRequestLog() *requestLog {
+	var id [8]byte
+	// crypto/rand.Read only fails if the OS can't supply randomness, in which
+	// case the zero ID is still better than no log line.
+	rand.Read(id[:])
+	return &requestLog{
+		ID:      hex.EncodeToString(id[:]),
+		Start:   time.Now(),
+		Outcome: "unknown",
+	}
+}
+
+// write logs the request details.
+func (l *requestLog) write() {
+	log.Printf(
+		"request_id=%s server_name=%q tls_sni=%q addrs=%v duration=%v outcome=%q",
+		l.ID, l.ServerName, l.TLSSNI, l.Addrs, time.Since(l.Start), l.Outcome,
+	)
+}
@@ -2,143 +2,794 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/matrix-org/golang-matrixfederation"
 	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// connectionTimeout is the default time allowed for probing each server address.
+// It can be set using the CONNECTION_TIMEOUT_SECONDS environment variable.
+var connectionTimeout = 15 * time.Second
+
 // HandleReport handles an HTTP request for a JSON report for matrix server.
-// GET /api/report?server_name=matrix.org&tls_sni=whatever request.
+// GET /api/report?server_name=matrix.org&tls_sni=whatever&timeout=10&no_cache=1&format=text request.
+// POST /api/report {"server_name": "matrix.org", "tls_sni": "whatever", "timeout": 10, "no_cache": true} request.
 func HandleReport(w http.ResponseWriter, req *http.Request) {
-	// Set unrestricted Access-Control headers so that this API can be used by
-	// web apps running in browsers.
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+	setCORSHeaders(w, "GET, POST")
 	if req.Method == "OPTIONS" {
 		return
 	}
-	if req.Method != "GET" {
-		w.WriteHeader(405)
-		fmt.Printf("Unsupported method.")
+	rlog := newRequestLog()
+	defer rlog.write()
+	w.Header().Set("X-Request-ID", rlog.ID)
+	// The format defaults to text if the Accept header asks for it.
+	w.Header().Set("Vary", "Accept")
+	if req.Method != "GET" && req.Method != "POST" {
+		rlog.Outcome = "unsupported method"
+		writeJSONError(w, 405, fmt.Errorf("Unsupported method %q", req.Method))
 		return
 	}
-	serverName := req.URL.Query().Get("server_name")
-	tlsSNI := req.URL.Query().Get("tls_sni")
-	result, err := JSONReport(serverName, tlsSNI)
+	request, err := parseReportRequest(req)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Printf("Error Generating Report: %q", err.Error())
-	} else {
-		w.Header().Set("Content-Type", "application/json")
+		rlog.Outcome = "bad request: " + err.Error()
+		writeJSONError(w, 400, err)
+		return
+	}
+	rlog.ServerName, rlog.TLSSNI = request.ServerName, request.TLSSNI
+	report, err := cachedReport(req.Context(), *request)
+	if err == errReportCancelled {
+		// The client has gone away so there's no one to send a response to.
+		rlog.Outcome = "cancelled"
+		return
+	}
+	if err != nil {
+		rlog.Outcome = "error: " + err.Error()
+		writeJSONError(w, reportErrorStatus(w, err, 500), err)
+		return
+	}
+	rlog.Addrs = report.DNSResult.Addrs
+	rlog.Outcome = report.Summary
+	setCacheHeaders(w, report, time.Now())
+	if request.Format == formatText {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(200)
+		w.Write(encodeReportText(request.ServerName, report))
+		return
+	}
+	if request.Format == formatPrometheus {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
 		w.WriteHeader(200)
-		w.Write(result)
+		w.Write(encodeReportPrometheus(request.ServerName, report))
+		return
+	}
+	var result []byte
+	if request.Format == formatLegacy {
+		result, err = encodeJSON(toLegacyReport(report), request.pretty())
+	} else {
+		result, err = encodeReport(report, request.pretty())
+	}
+	if err != nil {
+		rlog.Outcome = "error: " + err.Error()
+		writeJSONError(w, 500, err)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(result)
 }
 
-// JSONReport generates a JSON formatted report for a matrix server.
-func JSONReport(serverName, sni string) ([]byte, error) {
-	results, err := Report(serverName, sni)
+// cachedReport returns a report for the request, using the cache unless the request asked us not to.
+// The returned report has already been touched up for JSON serialisation.
+// Reports that are cancelled by the context aren't cached.
+// Generating a new report takes one of the in-flight slots, see acquireReportSlot.
+func cachedReport(ctx context.Context, request ReportRequest) (*ServerReport, error) {
+	key := request.cacheKey()
+	now := time.Now()
+	if !request.NoCache {
+		if report := reports.get(key, now); report != nil {
+			reportCacheHits.Inc()
+			return report, nil
+		}
+		reportCacheMisses.Inc()
+	}
+	if !acquireReportSlot() {
+		return nil, errTooManyReports
+	}
+	defer releaseReportSlot()
+	report, err := reportWithOptions(ctx, request.ServerName, request.sni(), request.timeout(), request.options())
 	if err != nil {
 		return nil, err
 	}
-	results.touchUpReport()
-	encoded, err := json.Marshal(results)
+	report.touchUpReport()
+	reports.put(key, report, now)
+	return report, nil
+}
+
+// JSONReport generates a JSON formatted report for a matrix server.
+func JSONReport(serverName, sni string, timeout time.Duration) ([]byte, error) {
+	results, err := Report(serverName, sni, timeout)
 	if err != nil {
 		return nil, err
 	}
+	results.touchUpReport()
+	return encodeReport(results, true)
+}
+
+// encodeReport encodes a ServerReport as JSON, which is indented if pretty is set.
+// The errors in the report must already have been touched up.
+func encodeReport(results *ServerReport, pretty bool) ([]byte, error) {
+	return encodeJSON(results, pretty)
+}
+
+// encodeJSON encodes a value as JSON, which is indented if pretty is set.
+func encodeJSON(v interface{}, pretty bool) ([]byte, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil || !pretty {
+		return encoded, err
+	}
 	var buffer bytes.Buffer
 	json.Indent(&buffer, encoded, "", "  ")
 	return buffer.Bytes(), nil
 }
 
+// bindAddress is the "[<host>]:<port>" to listen for HTTP requests on.
+// It can be set using the BIND_ADDRESS environment variable.
+var bindAddress = ":8080"
+
+// validateBindAddress checks that a BIND_ADDRESS is a "[<host>]:<port>" that net.Listen accepts.
+// The host is optional, to listen on every interface, but the port isn't.
+func validateBindAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if port == "" {
+		return fmt.Errorf("missing port in address %q", addr)
+	}
+	if _, err = net.LookupPort("tcp", port); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newAPIMux returns the mux serving the API on bindAddress. This isn't the default mux
+// since importing net/http/pprof registers the profiling endpoints on that.
+func newAPIMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/report", prometheus.InstrumentHandlerFunc("report", rateLimited(HandleReport)))
+	mux.HandleFunc("/api/report-batch", prometheus.InstrumentHandlerFunc("report-batch", HandleReportBatch))
+	mux.HandleFunc("/api/keys", prometheus.InstrumentHandlerFunc("keys", rateLimited(HandleKeys)))
+	mux.HandleFunc("/api/diff", prometheus.InstrumentHandlerFunc("diff", HandleDiff))
+	mux.HandleFunc("/api/verdict", prometheus.InstrumentHandlerFunc("verdict", rateLimited(HandleVerdict)))
+	mux.HandleFunc("/report", prometheus.InstrumentHandlerFunc("html-report", rateLimited(HandleHTMLReport)))
+	mux.HandleFunc("/api/schema", HandleSchema)
+	mux.Handle("/metrics", prometheus.Handler())
+	mux.HandleFunc("/healthz", HandleHealthz)
+	mux.HandleFunc("/version", HandleVersion)
+	mux.HandleFunc("/readyz", HandleReadyz)
+	return mux
+}
+
+// shutdownTimeout is how long we wait for in-flight requests to finish when shutting down.
+const shutdownTimeout = 60 * time.Second
+
 func main() {
-	http.HandleFunc("/api/report", prometheus.InstrumentHandlerFunc("report", HandleReport))
-	http.Handle("/metrics", prometheus.Handler())
-	http.ListenAndServe(os.Getenv("BIND_ADDRESS"), nil)
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(version)
+		return
+	}
+	registerMetrics()
+	configureFromEnv()
+	if flag.NArg() > 0 {
+		// Run a command rather than starting the HTTP server.
+		os.Exit(runCommand(flag.Args()))
+	}
+	// Listen before starting the server so that we fail straight away if the address is in use.
+	listener, err := net.Listen("tcp", bindAddress)
+	if err != nil {
+		log.Fatalf("Cannot listen on BIND_ADDRESS %q: %v", bindAddress, err)
+	}
+	log.Printf("Listening on %s", listener.Addr())
+	if enablePprof {
+		startPprof()
+	}
+	server := &http.Server{Addr: bindAddress, Handler: newAPIMux()}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a signal then stop accepting new requests and let the in-flight ones finish.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Shutting down after %v, waiting up to %v for requests to finish", <-signals, shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down: %v", err)
+	}
+}
+
+// configureFromEnv reads the configuration from the environment variables.
+func configureFromEnv() {
+	if str := os.Getenv("BIND_ADDRESS"); str != "" {
+		if err := validateBindAddress(str); err != nil {
+			log.Fatalf("Invalid BIND_ADDRESS: %v", err)
+		}
+		bindAddress = str
+	}
+	secondsFromEnv("CONNECTION_TIMEOUT_SECONDS", &connectionTimeout)
+	if connectionTimeout <= 0 {
+		log.Fatal("CONNECTION_TIMEOUT_SECONDS must be positive")
+	}
+	secondsFromEnv("REPORT_CACHE_TTL_SECONDS", &reportCacheTTL)
+	secondsFromEnv("DNS_CACHE_TTL_SECONDS", &dnsCacheTTL)
+	secondsFromEnv("DIAL_TIMEOUT_SECONDS", &dialTimeout)
+	secondsFromEnv("TLS_HANDSHAKE_TIMEOUT_SECONDS", &tlsHandshakeTimeout)
+	if str := os.Getenv("MAX_PROBED_ADDRESSES"); str != "" {
+		var err error
+		if maxProbedAddresses, err = strconv.Atoi(str); err != nil || maxProbedAddresses < 1 {
+			log.Fatalf("Invalid MAX_PROBED_ADDRESSES: %q", str)
+		}
+	}
+	if str := os.Getenv("MAX_RESPONSE_BYTES"); str != "" {
+		var err error
+		if maxResponseBytes, err = strconv.ParseInt(str, 10, 64); err != nil || maxResponseBytes < 1 {
+			log.Fatalf("Invalid MAX_RESPONSE_BYTES: %q", str)
+		}
+	}
+	blockPrivateAddresses = os.Getenv("BLOCK_PRIVATE_ADDRESSES") == "1"
+	if list := os.Getenv("ALLOWED_NETWORKS"); list != "" {
+		var err error
+		if allowedNetworks, err = parseNetworks(list); err != nil {
+			log.Fatalf("Invalid ALLOWED_NETWORKS: %v", err)
+		}
+	}
+	enhancedDNS = os.Getenv("ENHANCED_DNS") == "1"
+	enablePprof = os.Getenv("ENABLE_PPROF") == "1"
+	if addr := os.Getenv("PPROF_BIND_ADDRESS"); addr != "" {
+		pprofBindAddress = addr
+	}
+	if addr := os.Getenv("DNS_SERVER"); addr != "" {
+		if err := useDNSServer(addr); err != nil {
+			log.Fatalf("Invalid DNS_SERVER %q: %v", addr, err)
+		}
+	}
+	if str := os.Getenv("DNS_LOOKUP_ATTEMPTS"); str != "" {
+		var err error
+		if dnsLookupAttempts, err = strconv.Atoi(str); err != nil || dnsLookupAttempts < 1 {
+			log.Fatalf("Invalid DNS_LOOKUP_ATTEMPTS: %q", str)
+		}
+	}
+	if str := os.Getenv("RATE_LIMIT_PER_MINUTE"); str != "" {
+		var err error
+		if rateLimitPerMinute, err = strconv.Atoi(str); err != nil || rateLimitPerMinute < 0 {
+			log.Fatalf("Invalid RATE_LIMIT_PER_MINUTE: %q", str)
+		}
+	}
+	if str := os.Getenv("RATE_LIMIT_BURST"); str != "" {
+		var err error
+		if rateLimitBurst, err = strconv.Atoi(str); err != nil || rateLimitBurst < 1 {
+			log.Fatalf("Invalid RATE_LIMIT_BURST: %q", str)
+		}
+	}
+	if str := os.Getenv("MAX_IN_FLIGHT_REQUESTS"); str != "" {
+		var err error
+		if maxInFlightRequests, err = strconv.Atoi(str); err != nil || maxInFlightRequests < 0 {
+			log.Fatalf("Invalid MAX_IN_FLIGHT_REQUESTS: %q", str)
+		}
+	}
+	if maxInFlightRequests > 0 {
+		inFlight = make(chan struct{}, maxInFlightRequests)
+	}
+	if version := os.Getenv("MIN_TLS_VERSION"); version != "" {
+		var ok bool
+		if minTLSVersion, ok = minTLSVersions[version]; !ok {
+			log.Fatalf("Invalid MIN_TLS_VERSION: %q", version)
+		}
+	}
+	verifyCertChain = os.Getenv("SKIP_CHAIN_VERIFICATION") != "1"
+	if path := os.Getenv("CA_BUNDLE_PATH"); path != "" {
+		var err error
+		if caBundleRoots, err = loadCABundle(path); err != nil {
+			log.Fatalf("Invalid CA_BUNDLE_PATH: %v", err)
+		}
+	}
+	userAgent = defaultUserAgent()
+	if agent := os.Getenv("USER_AGENT"); agent != "" {
+		userAgent = agent
+	}
+	if name := os.Getenv("READINESS_LOOKUP_NAME"); name != "" {
+		readinessLookupName = name
+	}
+}
+
+// secondsFromEnv sets value from an environment variable giving a whole number of seconds.
+// The value is left unchanged if the environment variable isn't set.
+func secondsFromEnv(name string, value *time.Duration) {
+	if str := os.Getenv(name); str != "" {
+		seconds, err := strconv.Atoi(str)
+		if err != nil || seconds < 0 {
+			log.Fatalf("Invalid %s: %q", name, str)
+		}
+		*value = time.Duration(seconds) * time.Second
+	}
 }
 
 // A ServerReport is a report for a matrix server.
 type ServerReport struct {
-	DNSResult         matrixfederation.DNSResult  // The result of looking up the server in DNS.
-	ConnectionReports map[string]ConnectionReport // The report for each server address we could connect to.
-	ConnectionErrors  map[string]error            // The errors for each server address we couldn't connect to.
+	ServerName           string                      // The name of the server reported on, with any internationalized labels encoded as punycode.
+	UnicodeServerName    string                      `json:",omitempty"` // The ServerName with its punycode labels decoded, if it has any.
+	WellKnownResult      *WellKnownResult            // The result of looking up the server's delegation in .well-known, or nil if it was skipped.
+	ExplicitPort         bool                        // The server name, or its .well-known delegation, had an explicit port so SRV records weren't used.
+	DNSResult            matrixfederation.DNSResult  // The result of looking up the server in DNS.
+	ResolutionSkipped    bool                        // A target_addr was given so the server name wasn't resolved and DNSResult only lists that address.
+	DNSServer            string                      // The "<ip>:<port>" of the DNS server the lookups were sent to, either DNS_SERVER or the first nameserver in resolv.conf.
+	DNSAttempts          int                         // How many times the DNS lookup was attempted, more than 1 if it was retried.
+	DNSFromCache         bool                        // The DNS result was served from the DNS cache rather than looked up for this report, see dnsCache. DNSAttempts is 0 if so.
+	AddressesTruncated   bool                        // The server had more than MAX_PROBED_ADDRESSES addresses so some weren't probed.
+	UsedDefaultPort      bool                        // There was no explicit port or SRV record so the default port 8448 was used.
+	ResolutionSteps      []string                    // How the addresses to connect to were chosen, in the order the spec tries them, e.g. "well-known: found -> matrix.example.com:8448".
+	CNAMEChain           []string                    // The CNAMEs followed when resolving the server's host, starting with the host, or empty if it isn't a CNAME.
+	SRVTargetCNAMEs      map[string][]string         // The CNAME chains of the SRV record targets that are CNAMEs, which RFC 2782 forbids, keyed by target.
+	DNSRecords           []DNSRecord                 // Best effort: the SRV, CNAME, A and AAAA records of the server with their TTLs, only looked up if ENHANCED_DNS is set.
+	KeyServerName        string                      // The server name the keys were validated against.
+	ConnectionHost       string                      // The host that was connected to, which the certificates must be valid for: the delegated host if .well-known delegated the server, otherwise the server name's host.
+	ConnectionReports    map[string]ConnectionReport // The report for each server address we could connect to.
+	ConnectionErrors     map[string]error            // The errors for each server address we couldn't connect to.
+	Addresses            []AddressResult             // The report or error for each server address sorted by address. This is the canonical form of ConnectionReports and ConnectionErrors, which are kept for compatibility.
+	AddressFamilies      map[string]FamilySummary    // How many of the server addresses connected for "IPv4" and "IPv6".
+	FirstSuccess         string                      // The address that returned keys first, by the time taken to connect, handshake and fetch them.
+	HappyEyeballsAddress string                      // The address a dual-stack client would have connected to, see connectionOrder.
+	InconsistentBackends bool                        // The addresses that connected returned different verify keys or versions, see compareBackends.
+	BackendDifferences   []BackendDifference         // What differed between the addresses if InconsistentBackends is set.
+	FederationOK         bool                        // Did at least one address connect with every connected address passing the key checks, other than the SkippedChecks?
+	StrictFederationOK   bool                        // Did at least one address connect with every connected address passing the strict rules a modern homeserver applies, see strict.go?
+	Verdict              string                      // Why federation is or isn't OK: "ok", "no_addresses", "no_connections" or "key_checks_failed".
+	Resolved             bool                        // Did the server resolve to at least one address?
+	AnyConnected         bool                        // Did at least one address connect and return keys?
+	SkippedChecks        []string                    // The verdictChecks that were skipped using skip_checks, so don't count towards FederationOK.
+	Summary              string                      // Human readable explanation of FederationOK.
+	Score                int                         // A 0 to 100 summary of the health of federation, see score.go.
+	ScoreFactors         []ScoreFactor               // How the Score was made up.
+	Warnings             []ReportWarning             // Problems that don't stop federation working now but are likely to break it, as opposed to the ConnectionErrors that stop it working.
+	Timings              Timings                     // How long each stage of generating the report took.
+	GeneratedAt          time.Time                   // When the report was generated.
+	CheckedAt            time.Time                   // The time the validity of the keys and certificates was checked at, which is GeneratedAt unless the request gave another time in at.
+	Cached               bool                        // Was the report served from the cache rather than freshly generated?
+}
+
+// An AddressResult is the outcome of probing one server address, in the order of ServerReport.Addresses.
+type AddressResult struct {
+	Address string            // The "<ip>:<port>" of the server address.
+	Report  *ConnectionReport `json:",omitempty"` // The report on the connection, if we could connect.
+	Error   error             `json:",omitempty"` // Why we couldn't connect, if we couldn't.
+}
+
+// Timings records how long each stage of generating a report took.
+type Timings struct {
+	WellKnownMS float64                   // Milliseconds taken to look up the .well-known delegation.
+	DNSMS       float64                   // Milliseconds taken to look up the server in DNS.
+	Addresses   map[string]AddressTimings // How long fetching the keys took for each server address we could connect to.
 }
 
 // A ConnectionReport is information about a connection made to a matrix server.
 type ConnectionReport struct {
+	AddressFamily         string                                   // The address family of this server address, "IPv4" or "IPv6".
 	Certificates          []X509CertSummary                        // Summary information for each x509 certificate served up by this server.
+	ChainExpiresAt        time.Time                                // The earliest NotAfter of the certificates served, which may be an intermediate's rather than the leaf's.
+	ChainDaysUntilExpiry  int                                      // The number of whole days until ChainExpiresAt, negative if it has passed.
+	ChainVerified         *bool                                    // The certificate chain builds to a trusted root, or nil if chain verification is disabled.
+	ChainError            error                                    // Why the certificate chain didn't verify.
+	TrustStore            string                                   // The roots the chain was verified against, "system" or "ca_bundle" if CA_BUNDLE_PATH is set, or empty if chain verification is disabled.
+	IncompleteChain       bool                                     // The chain didn't verify because the server didn't send the intermediate certificates, see isIncompleteChain.
+	OCSPStatus            string                                   // The status in the OCSP response stapled to the handshake, "good", "revoked", "unknown" or "none" if there wasn't one.
+	OCSPError             error                                    // Why the stapled OCSP response couldn't be verified, in which case OCSPStatus is "unknown".
 	Cipher                CipherSummary                            // Summary information on the TLS cipher used by this server.
+	NegotiatedProtocol    string                                   // The ALPN protocol negotiated in the TLS handshake, normally empty since we don't offer any.
+	ClientCertRequested   bool                                     // The server asked for a client certificate, but accepted the connection without one.
+	CoversServerName      bool                                     // The subject alternative names of the leaf certificate include the TLS SNI sent.
+	CoversOriginalName    *bool                                    // The leaf certificate covers the original server name, which it needn't, or nil if the server wasn't delegated to another host.
+	MatchedViaWildcard    bool                                     // CoversServerName is true because of a wildcard name rather than an exact match.
+	SNIRequired           *bool                                    // A handshake without SNI failed or served a different certificate, or nil if tls_sni was given or it timed out.
+	SNIResults            map[string]SNIResult                     // The certificates served for each TLS SNI, keyed by SNI, if tls_sni listed several, or nil.
+	SessionResumed        *bool                                    // A second handshake resumed the TLS session of the first, or nil if check_resumption wasn't given or it timed out.
 	Keys                  *json.RawMessage                         // The server key JSON returned by this server.
+	KeyContentType        string                                   // The Content-Type header of the key response.
+	KeyContentTypeOK      bool                                     // The KeyContentType is application/json. This is advisory and doesn't affect FederationOK.
 	Checks                matrixfederation.KeyChecks               // The checks applied to the server and their results.
+	KeysSHA256            matrixfederation.Base64String            // The SHA-256 hash of the key JSON, which is the same for addresses that return byte-identical keys.
+	KeyChecksReused       bool                                     // The Checks and SignatureChecks were reused from another address that returned the same keys and certificate, see keyCheckCache.
+	ChecksSummary         map[string]bool                          // The results of the checks keyed by stable names, see checks.go.
+	FailedChecks          []string                                 // The verdictChecks that failed, other than the skipped ones.
+	StrictFailures        []string                                 // The strict rules this address failed, see strictFailures.
+	FingerprintMatch      bool                                     // The fingerprint of the leaf certificate is one of the tls_fingerprints in the keys, the same as the matching_tls_fingerprint check.
+	FingerprintMismatch   *FingerprintMismatch                     // The fingerprints if the keys list tls_fingerprints but none of them match, or nil.
+	KeyValidUntil         time.Time                                // The valid_until_ts of the keys.
+	KeyExpired            bool                                     // The valid_until_ts of the keys is not in the future.
+	KeyValidForSeconds    int64                                    // The number of whole seconds until the valid_until_ts of the keys, negative if it has passed.
+	ClockSkewSuspected    bool                                     // The valid_until_ts has passed or is within minPlausibleKeyValidity, which suggests the server's clock is wrong.
 	Ed25519VerifyKeys     map[string]matrixfederation.Base64String // The Verify keys for this server or nil if the checks were not ok.
 	SHA256TLSFingerprints []matrixfederation.Base64String          // The SHA256 tls fingerprints for this server or nil if the checks were not ok.
+	Version               VersionReport                            // The server implementation advertised by this server.
+	SignatureChecks       map[string]SignatureCheck                // The checks on the self-signatures of the server key document, by key ID.
+	VerifyKeys            map[string]VerifyKey                     // Every key in "verify_keys" of the server key document, by key ID.
+	OldVerifyKeys         map[string]OldVerifyKey                  // The keys in "old_verify_keys" of the server key document, by key ID.
 }
 
 // A CipherSummary is a summary of the TLS version and Cipher used in a TLS connection.
 type CipherSummary struct {
-	Version     string // Human readable description of the TLS version.
-	CipherSuite string // Human readable description of the TLS cipher.
+	Version        string // Human readable description of the TLS version.
+	CipherSuite    string // Human readable description of the TLS cipher.
+	Grade          string // How secure the cipher is: "strong", "acceptable", "weak", "insecure" or "unknown".
+	ForwardSecrecy bool   // The cipher uses an ephemeral key exchange.
 }
 
 // A X509CertSummary is a summary of the information in a X509 certificate.
 type X509CertSummary struct {
-	SubjectCommonName string                        // The common name of the subject.
-	IssuerCommonName  string                        // The common name of the issuer.
-	SHA256Fingerprint matrixfederation.Base64String // The SHA256 fingerprint of the certificate.
-	DNSNames          []string                      // The DNS names this certificate is valid for.
+	SubjectCommonName  string                        // The common name of the subject.
+	IssuerCommonName   string                        // The common name of the issuer.
+	SHA256Fingerprint  matrixfederation.Base64String // The SHA256 fingerprint of the certificate.
+	DNSNames           []string                      // The DNS names this certificate is valid for.
+	IPAddresses        []string                      // The IP addresses this certificate is valid for.
+	NotBefore          time.Time                     // The time the certificate becomes valid.
+	NotAfter           time.Time                     // The time the certificate expires.
+	Expired            bool                          // The certificate has expired.
+	DaysUntilExpiry    int                           // The number of whole days until the certificate expires, rounded down so it is negative as soon as it has expired.
+	IsCA               bool                          // The certificate is a CA certificate.
+	ChainIndex         int                           // The position of the certificate in the chain served by the server, starting from 0 for the leaf.
+	SelfSigned         bool                          // The certificate is issued by its own subject and signed by its own key.
+	PublicKeyAlgorithm string                        // The algorithm of the certificate's public key, e.g. "RSA".
+	PublicKeyBits      int                           // The size of the certificate's public key in bits, e.g. the modulus size for RSA, or 0 if the algorithm isn't known.
+	SignatureAlgorithm string                        // The algorithm the certificate is signed with, e.g. "SHA256-RSA".
 }
 
 // Report creates a ServerReport for a matrix server.
-func Report(serverName string, sni string) (*ServerReport, error) {
+// If the server delegates federation using .well-known then the delegated
+// server is used for DNS resolution, the TLS SNI and the Host header, while
+// the original server name is used to validate the keys.
+// Each server address must respond within the timeout.
+func Report(serverName string, sni string, timeout time.Duration) (*ServerReport, error) {
+	return reportWithOptions(context.Background(), serverName, sni, timeout, reportOptions{})
+}
+
+// reportOptions are the less common options for generating a report.
+// The zero value gives the behaviour described by the spec.
+type reportOptions struct {
+	keyServerName   string    // The server name used to validate the keys, or empty to use the requested server name.
+	targetAddr      string    // The "<ip>:<port>" to connect to instead of resolving the server name, or empty to resolve it.
+	skipChecks      []string  // The names of the verdictChecks that don't count towards the verdict.
+	checkResumption bool      // Whether to check if each address supports TLS session resumption.
+	freshDNS        bool      // Look the server up in DNS even if there is a cached result.
+	extraSNIs       []string  // The other TLS SNIs to handshake with at each address if several were given, see probeSNIs.
+	at              time.Time // The time to check the validity of the keys and certificates at, or the zero time for the current time.
+}
+
+// errReportCancelled is returned when the context for a report is cancelled
+// before the report is finished, normally because the client disconnected.
+var errReportCancelled = errors.New("The report was cancelled before it finished")
+
+// reportWithOptions creates a ServerReport for a matrix server like Report.
+// If the context is cancelled then any outstanding network requests are
+// abandoned and errReportCancelled is returned.
+func reportWithOptions(ctx context.Context, serverName string, sni string, timeout time.Duration, options reportOptions) (*ServerReport, error) {
+	start := time.Now()
+	report, err := generateReport(ctx, serverName, sni, timeout, options)
+	recordReportMetrics(report, err, time.Since(start))
+	return report, err
+}
+
+func generateReport(ctx context.Context, serverName string, sni string, timeout time.Duration, options reportOptions) (*ServerReport, error) {
 	var report ServerReport
-	dnsResult, err := matrixfederation.LookupServer(serverName)
-	if err != nil {
-		return nil, err
+	report.Timings.Addresses = map[string]AddressTimings{}
+	connectName := serverName
+	if options.targetAddr != "" {
+		// Skip resolution and connect to the address we were given.
+		report.ResolutionSkipped = true
+		report.DNSResult = matrixfederation.DNSResult{Addrs: []string{options.targetAddr}}
+		report.ResolutionSteps = []string{fmt.Sprintf("target_addr: -> %s", options.targetAddr)}
+	} else {
+		var err error
+		if connectName, err = report.resolve(ctx, serverName, timeout, options.freshDNS); err != nil {
+			return nil, err
+		}
+	}
+	// Only check whether SNI is required if we weren't told which SNI to send.
+	checkSNI := sni == ""
+	if sni == "" {
+		sni = hostOf(connectName)
 	}
-	report.DNSResult = *dnsResult
 	// Map of network address to report.
 	report.ConnectionReports = make(map[string]ConnectionReport)
 	// Map of network address to connection error.
 	report.ConnectionErrors = make(map[string]error)
+	report.ServerName = serverName
+	report.UnicodeServerName = unicodeServerName(serverName)
+	report.ConnectionHost = hostOf(connectName)
+	report.KeyServerName = serverName
+	if options.keyServerName != "" {
+		report.KeyServerName = options.keyServerName
+	}
+	p := prober{
+		serverName:      report.KeyServerName,
+		connectName:     connectName,
+		sni:             sni,
+		checkSNI:        checkSNI,
+		checkResumption: options.checkResumption,
+		extraSNIs:       options.extraSNIs,
+		delegatedFrom:   delegatedFrom(serverName, connectName),
+		timeout:         timeout,
+		now:             time.Now(),
+	}
+	report.GeneratedAt = p.now
+	if !options.at.IsZero() {
+		p.now = options.at
+	}
+	report.CheckedAt = p.now
+	report.SkippedChecks = options.skipChecks
+	report.probeAll(ctx, &p, report.limitAddrs())
+	if ctx.Err() != nil {
+		return nil, errReportCancelled
+	}
+	report.summarizeFamilies()
+	report.compareBackends()
+	report.computeVerdict()
+	report.computeStrictVerdict()
+	report.computeScore()
+	report.collectWarnings()
+	return &report, nil
+}
+
+// resolve looks up the server's .well-known delegation and then looks up the delegated server in DNS.
+// Returns the name of the server to connect to, which is the delegated server if there is one.
+// The .well-known lookup must finish within the timeout.
+// The DNS lookup uses the dnsResults cache unless freshDNS is set.
+func (report *ServerReport) resolve(ctx context.Context, serverName string, timeout time.Duration, freshDNS bool) (string, error) {
+	connectName := serverName
+	if !hasExplicitPort(serverName) && !isIPLiteral(serverName) {
+		wellKnownStart := time.Now()
+		report.WellKnownResult = lookupWellKnown(ctx, serverName, timeout)
+		report.Timings.WellKnownMS = milliseconds(time.Since(wellKnownStart))
+		if report.WellKnownResult.ServerAddress != "" {
+			connectName = report.WellKnownResult.ServerAddress
+		}
+	}
+	// An explicit port means that LookupServer connects to that port rather than looking up SRV records.
+	report.ExplicitPort = hasExplicitPort(connectName)
+	report.DNSServer = dnsServerAddr()
+	dnsStart := time.Now()
+	err := report.lookupDNS(ctx, connectName, freshDNS)
+	report.Timings.DNSMS = milliseconds(time.Since(dnsStart))
+	if err != nil {
+		return "", err
+	}
+	// Without an explicit port or a SRV record LookupServer falls back to the default port.
+	report.UsedDefaultPort = !report.ExplicitPort && len(report.DNSResult.SRVRecords) == 0
+	report.ResolutionSteps = report.resolutionSteps(serverName, connectName)
+	return connectName, nil
+}
+
+// lookupDNS looks up the server to connect to in DNS, using the dnsResults cache unless fresh is set.
+// Lookups that found addresses are added to the cache.
+func (report *ServerReport) lookupDNS(ctx context.Context, connectName string, fresh bool) error {
+	name := lookupName(connectName)
 	now := time.Now()
+	if entry, ok := dnsResults.get(name, now); ok && !fresh {
+		report.DNSResult, report.CNAMEChain, report.DNSFromCache = entry.result, entry.cnameChain, true
+		report.SRVTargetCNAMEs, report.DNSRecords = entry.srvTargetCNAMEs, entry.records
+		return nil
+	}
+	dnsResult, attempts, err := lookupServer(ctx, name)
+	if err == errReportCancelled {
+		return err
+	}
+	if err != nil {
+		message := err.Error()
+		if attempts > 1 {
+			message = fmt.Sprintf("%s (after %d attempts)", message, attempts)
+		}
+		return ReportError{Code: dnsErrorCode(err), Message: message}
+	}
+	report.DNSAttempts = attempts
+	report.CNAMEChain = lookupCNAMEChain(ctx, hostOf(connectName))
+	report.SRVTargetCNAMEs = lookupSRVTargetCNAMEs(ctx, dnsResult.SRVRecords)
+	if enhancedDNS {
+		report.DNSRecords = lookupDNSRecords(ctx, connectName, dnsResult.SRVRecords)
+	}
+	report.DNSResult = *dnsResult
+	if len(dnsResult.Addrs) > 0 {
+		dnsResults.put(name, dnsCacheEntry{
+			result:          *dnsResult,
+			cnameChain:      report.CNAMEChain,
+			srvTargetCNAMEs: report.SRVTargetCNAMEs,
+			records:         report.DNSRecords,
+			stored:          now,
+		})
+	}
+	return nil
+}
+
+// probeAll probes the addresses concurrently, recording a report or error for each of them.
+func (report *ServerReport) probeAll(ctx context.Context, p *prober, addrs []string) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	// Limit the number of addresses we probe at once.
+	inFlight := make(chan struct{}, maxConcurrentProbes)
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			inFlight <- struct{}{}
+			connReport, timings, err := p.probe(ctx, addr)
+			<-inFlight
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				report.ConnectionErrors[addr] = err
+			} else {
+				report.ConnectionReports[addr] = *connReport
+				report.Timings.Addresses[addr] = *timings
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// The maximum number of addresses that a single report will probe concurrently.
+const maxConcurrentProbes = 8
+
+// maxProbedAddresses is the maximum number of addresses that a single report will probe.
+// It can be set using the MAX_PROBED_ADDRESSES environment variable.
+var maxProbedAddresses = 20
+
+// errAddressNotProbed is the connection error for the addresses skipped because of maxProbedAddresses.
+var errAddressNotProbed = errors.New("Not probed because the server has too many addresses")
+
+// wasProbed returns false if a connection error is for an address that was skipped,
+// either because of maxProbedAddresses or because checkAddress blocked it.
+func wasProbed(err error) bool {
+	return err != errAddressNotProbed && errorCode(err) != codeAddressBlocked
+}
+
+// limitAddrs returns the distinct addresses in the DNS result to probe, up to maxProbedAddresses of them.
+// Addresses blocked by checkAddress are never probed. The addresses that are skipped
+// are recorded in ConnectionErrors, and AddressesTruncated is set if there were too many.
+func (report *ServerReport) limitAddrs() []string {
+	var addrs []string
+	seen := map[string]bool{}
 	for _, addr := range report.DNSResult.Addrs {
-		keys, connState, err := matrixfederation.FetchKeysDirect(serverName, addr, sni)
-		if err != nil {
-			report.ConnectionErrors[addr] = err
+		if seen[addr] {
 			continue
 		}
-		var connReport ConnectionReport
-		for _, cert := range connState.PeerCertificates {
-			fingerprint := sha256.Sum256(cert.Raw)
-			summary := X509CertSummary{
-				SubjectCommonName: cert.Subject.CommonName,
-				IssuerCommonName:  cert.Issuer.CommonName,
-				SHA256Fingerprint: fingerprint[:],
-				DNSNames:          cert.DNSNames,
-			}
-			connReport.Certificates = append(connReport.Certificates, summary)
+		seen[addr] = true
+		if err := checkAddress(addr); err != nil {
+			report.ConnectionErrors[addr] = err
+		} else if len(addrs) < maxProbedAddresses {
+			addrs = append(addrs, addr)
+		} else {
+			report.AddressesTruncated = true
+			report.ConnectionErrors[addr] = errAddressNotProbed
 		}
-		connReport.Cipher.Version = enumToString(tlsVersions, connState.Version)
-		connReport.Cipher.CipherSuite = enumToString(tlsCipherSuites, connState.CipherSuite)
-		connReport.Checks, connReport.Ed25519VerifyKeys, connReport.SHA256TLSFingerprints = matrixfederation.CheckKeys(serverName, now, *keys, connState)
-		raw := json.RawMessage(keys.Raw)
-		connReport.Keys = &raw
-		report.ConnectionReports[addr] = connReport
 	}
-	return &report, nil
+	return addrs
+}
+
+// A prober connects to the addresses of a matrix server.
+type prober struct {
+	serverName      string        // The server name used to validate the keys.
+	connectName     string        // The server name used in the Host header of the key request.
+	sni             string        // The TLS SNI to send when connecting.
+	checkSNI        bool          // Whether to also handshake without SNI to see if the SNI is required.
+	checkResumption bool          // Whether to also check if the address supports TLS session resumption.
+	extraSNIs       []string      // The other TLS SNIs to handshake with, see probeSNIs.
+	delegatedFrom   string        // The host of the server name if .well-known delegated it to another host, or empty.
+	timeout         time.Duration // The time allowed to probe each address, shared by every request made to it.
+	now             time.Time     // The time used to check the validity of the keys.
+	keyChecks       keyCheckCache // The results of checking the keys, shared between addresses that return the same keys.
+}
+
+// probe creates a ConnectionReport for a single server address.
+// Also returns how long fetching the keys from the address took.
+// Fetching the keys and the extra handshakes and requests that follow it share
+// a single deadline, so probing an address never takes much longer than the timeout.
+func (p *prober) probe(ctx context.Context, addr string) (*ConnectionReport, *AddressTimings, error) {
+	deadline := time.Now().Add(p.timeout)
+	keys, response, err := fetchKeysDirect(ctx, p.connectName, addr, p.sni, p.timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	connState := &response.ConnState
+	var connReport ConnectionReport
+	connReport.AddressFamily = addressFamily(addr)
+	for i, cert := range connState.PeerCertificates {
+		summary := summarizeCertificate(cert, p.now)
+		summary.ChainIndex = i
+		connReport.Certificates = append(connReport.Certificates, summary)
+	}
+	connReport.ChainExpiresAt, connReport.ChainDaysUntilExpiry = chainExpiry(connReport.Certificates)
+	if verifyCertChain {
+		connReport.TrustStore = trustStore()
+		connReport.ChainError = verifyChain(connState.PeerCertificates, p.now)
+		aiaCtx, cancel := context.WithDeadline(ctx, deadline)
+		connReport.IncompleteChain = isIncompleteChain(aiaCtx, connState.PeerCertificates, connReport.ChainError, p.now)
+		cancel()
+		verified := connReport.ChainError == nil
+		connReport.ChainVerified = &verified
+	}
+	connReport.OCSPStatus, connReport.OCSPError = checkOCSPStaple(connState.OCSPResponse, connState.PeerCertificates, p.now)
+	if len(connReport.Certificates) > 0 {
+		connReport.CoversServerName, connReport.MatchedViaWildcard = certCoversName(connReport.Certificates[0], p.sni)
+		if p.delegatedFrom != "" {
+			coversOriginal, _ := certCoversName(connReport.Certificates[0], p.delegatedFrom)
+			connReport.CoversOriginalName = &coversOriginal
+		}
+	}
+	connReport.Cipher.Version = enumToString(tlsVersions, connState.Version)
+	connReport.Cipher.CipherSuite = enumToString(tlsCipherSuites, connState.CipherSuite)
+	connReport.Cipher.Grade, connReport.Cipher.ForwardSecrecy = gradeCipher(connState.Version, connState.CipherSuite)
+	connReport.NegotiatedProtocol = connState.NegotiatedProtocol
+	connReport.ClientCertRequested = response.ClientCertRequested
+	if p.checkSNI {
+		connReport.SNIRequired = sniRequired(ctx, addr, connState, time.Until(deadline))
+	}
+	if len(p.extraSNIs) > 0 {
+		connReport.SNIResults = probeSNIs(ctx, addr, p.sni, connReport.Certificates, p.extraSNIs, p.now, time.Until(deadline))
+	}
+	if p.checkResumption {
+		var handshake time.Duration
+		connReport.SessionResumed, handshake = checkResumption(ctx, p.connectName, addr, p.sni, time.Until(deadline))
+		response.Timings.ResumedTLSHandshakeMS = milliseconds(handshake)
+	}
+	keyChecks, reused := p.keyChecks.check(p.serverName, p.now, *keys, connState)
+	connReport.Checks, connReport.Ed25519VerifyKeys, connReport.SHA256TLSFingerprints = keyChecks.checks, keyChecks.ed25519VerifyKeys, keyChecks.fingerprints
+	connReport.KeyChecksReused = reused
+	keysHash := sha256.Sum256(keys.Raw)
+	connReport.KeysSHA256 = keysHash[:]
+	connReport.ChecksSummary = summarizeChecks(connReport.Checks)
+	connReport.FingerprintMatch, connReport.FingerprintMismatch = checkFingerprint(*keys, connReport.Certificates)
+	connReport.KeyValidUntil = time.Unix(0, keys.ValidUntilTS*int64(time.Millisecond)).UTC()
+	connReport.KeyExpired = !connReport.KeyValidUntil.After(p.now)
+	connReport.KeyValidForSeconds = int64(connReport.KeyValidUntil.Sub(p.now) / time.Second)
+	connReport.ClockSkewSuspected = connReport.KeyValidUntil.Sub(p.now) < minPlausibleKeyValidity
+	connReport.SignatureChecks = keyChecks.signatureChecks
+	connReport.VerifyKeys = summarizeVerifyKeys(keys.Raw, connReport.SignatureChecks)
+	connReport.OldVerifyKeys = summarizeOldVerifyKeys(*keys, p.now)
+	connReport.StrictFailures = strictFailures(connReport, connState.Version)
+	raw := json.RawMessage(keys.Raw)
+	connReport.Keys = &raw
+	connReport.KeyContentType = response.Header.Get("Content-Type")
+	connReport.KeyContentTypeOK = isJSONContentType(connReport.KeyContentType)
+	connReport.Version = fetchVersionDirect(ctx, p.connectName, addr, p.sni, time.Until(deadline))
+	connReport.Version.checkMinimumVersion()
+	connReport.Version.SupportsFederationV2 = probeFederationV2(ctx, p.connectName, addr, p.sni, time.Until(deadline))
+	return &connReport, &response.Timings, nil
 }
 
 // A ReportError is a version of a golang error that is human readable when serialised as JSON.
 type ReportError struct {
+	Code    string `json:",omitempty"` // A stable code for the kind of error, see errorcodes.go. Only set for errors in reports.
+	Stage   string `json:",omitempty"` // The stage of probing a server address that failed, only set for connection errors.
 	Message string // The result of err.Error()
+	Raw     string `json:",omitempty"` // The original low-level error if Message was rewritten to be more helpful, see classifyError.
 }
 
 // Error implements the error interface.
@@ -147,23 +798,139 @@ func (e ReportError) Error() string {
 }
 
 // Replace a golang error with an error that is human readable when serialised as JSON.
-func asReportError(err error) error {
-	if err != nil {
-		return ReportError{err.Error()}
+// Errors that are already ReportErrors, including within a stageError, are kept as they are
+// except that they are given the code if they don't already have one.
+func asReportError(err error, code string) error {
+	if err == nil {
+		return nil
 	}
-	return nil
+	return toReportError(err, code)
+}
+
+// toReportError converts a non-nil error into a ReportError like asReportError.
+// The stage of a stageError is kept in the Stage of the ReportError.
+func toReportError(err error, code string) ReportError {
+	stage := ""
+	if stageErr, ok := err.(stageError); ok {
+		err, stage = stageErr.Err, stageErr.Stage
+	}
+	reportErr, ok := err.(ReportError)
+	if !ok {
+		reportErr = ReportError{Message: err.Error()}
+	}
+	if reportErr.Stage == "" {
+		reportErr.Stage = stage
+	}
+	if reportErr.Code == "" {
+		reportErr.Code = code
+	}
+	return reportErr
 }
 
 // touchUpReport converts all the errors in a ServerReport into forms that will be human readable after JSON serialisation.
 func (report *ServerReport) touchUpReport() {
-	report.DNSResult.SRVError = asReportError(report.DNSResult.SRVError)
+	if report.WellKnownResult != nil {
+		report.WellKnownResult.Error = asReportError(report.WellKnownResult.Error, codeWellKnownFailed)
+	}
+	report.DNSResult.SRVError = asReportError(report.DNSResult.SRVError, dnsErrorCode(report.DNSResult.SRVError))
 	for host, hostReport := range report.DNSResult.Hosts {
-		hostReport.Error = asReportError(hostReport.Error)
+		hostReport.Error = asReportError(hostReport.Error, dnsErrorCode(hostReport.Error))
 		report.DNSResult.Hosts[host] = hostReport
 	}
 	for addr, err := range report.ConnectionErrors {
-		report.ConnectionErrors[addr] = asReportError(err)
+		report.ConnectionErrors[addr] = asReportError(err, connectionErrorCode(err))
+	}
+	for addr, connReport := range report.ConnectionReports {
+		connReport.ChainError = asReportError(connReport.ChainError, chainErrorCode(connReport.ChainError))
+		connReport.Version.Error = asReportError(connReport.Version.Error, codeVersionFailed)
+		for sni, result := range connReport.SNIResults {
+			result.Error = asReportError(result.Error, connectionErrorCode(result.Error))
+			connReport.SNIResults[sni] = result
+		}
+		for keyID, check := range connReport.SignatureChecks {
+			check.Error = asReportError(check.Error, codeKeyInvalidSignature)
+			connReport.SignatureChecks[keyID] = check
+		}
+		for keyID, key := range connReport.VerifyKeys {
+			key.Error = asReportError(key.Error, codeKeyMalformed)
+			connReport.VerifyKeys[keyID] = key
+		}
+		for _, old := range connReport.OldVerifyKeys {
+			if old.Signature != nil {
+				old.Signature.Error = asReportError(old.Signature.Error, codeKeyInvalidSignature)
+			}
+		}
+		report.ConnectionReports[addr] = connReport
+	}
+	touchUpErrors(reflect.ValueOf(report).Elem())
+	report.Addresses = report.addressResults()
+}
+
+// addressResults lists the connection report or error for each server address in sorted order.
+func (report *ServerReport) addressResults() []AddressResult {
+	var results []AddressResult
+	for _, addr := range reportAddrs(report) {
+		if err, ok := report.ConnectionErrors[addr]; ok {
+			results = append(results, AddressResult{Address: addr, Error: err})
+			continue
+		}
+		connReport := report.ConnectionReports[addr]
+		results = append(results, AddressResult{Address: addr, Report: &connReport})
+	}
+	return results
+}
+
+// touchUpErrors walks a value replacing any errors in it that aren't ReportErrors yet,
+// so that errors in fields added to the report without updating touchUpReport aren't
+// serialised as "{}". Returns whether anything was replaced, since map entries are
+// only written back if they change so that maps shared with a cache aren't written to.
+// The value must be settable for its errors to be replaced.
+func touchUpErrors(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() || v.Type() != errorType {
+			return false
+		}
+		err := v.Interface().(error)
+		if _, ok := err.(ReportError); ok {
+			return false
+		}
+		v.Set(reflect.ValueOf(toReportError(err, "")))
+		return true
+	case reflect.Ptr:
+		return !v.IsNil() && touchUpErrors(v.Elem())
+	case reflect.Struct:
+		changed := false
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" && touchUpErrors(v.Field(i)) {
+				changed = true
+			}
+		}
+		return changed
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return false
+		}
+		changed := false
+		for i := 0; i < v.Len(); i++ {
+			if touchUpErrors(v.Index(i)) {
+				changed = true
+			}
+		}
+		return changed
+	case reflect.Map:
+		changed := false
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			if touchUpErrors(elem) {
+				v.SetMapIndex(key, elem)
+				changed = true
+			}
+		}
+		return changed
 	}
+	return false
 }
 
 // enumToString converts a uint16 enum into a human readable string using a fixed mapping.
@@ -177,16 +944,19 @@ func enumToString(names map[uint16]string, value uint16) string {
 
 var (
 	tlsVersions = map[uint16]string{
-		tls.VersionSSL30: "SSL 3.0",
 		tls.VersionTLS10: "TLS 1.0",
 		tls.VersionTLS11: "TLS 1.1",
 		tls.VersionTLS12: "TLS 1.2",
+		tls.VersionTLS13: "TLS 1.3",
 	}
 	tlsCipherSuites = map[uint16]string{
 		tls.TLS_RSA_WITH_RC4_128_SHA:                "TLS_RSA_WITH_RC4_128_SHA",
 		tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
 		tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
 		tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         "TLS_RSA_WITH_AES_128_CBC_SHA256",
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
 		tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
 		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
 		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
@@ -198,8 +968,13 @@ var (
 		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
 		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
 		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
-		// go1.5.3 doesn't have these enums, but they appear in more recent version.
-		// tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
-		// tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+		// TLS 1.3 cipher suites.
+		tls.TLS_AES_128_GCM_SHA256:       "TLS_AES_128_GCM_SHA256",
+		tls.TLS_AES_256_GCM_SHA384:       "TLS_AES_256_GCM_SHA384",
+		tls.TLS_CHACHA20_POLY1305_SHA256: "TLS_CHACHA20_POLY1305_SHA256",
 	}
 )
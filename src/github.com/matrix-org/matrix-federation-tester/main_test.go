@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEnumToString(t *testing.T, names map[uint16]string, value uint16, want string) {
+	if got := enumToString(names, value); got != want {
+		t.Errorf("enumToString(0x%x): want %q got %q", value, want, got)
+	}
+}
+
+func TestTLSVersionStrings(t *testing.T) {
+	testEnumToString(t, tlsVersions, tls.VersionTLS10, "TLS 1.0")
+	testEnumToString(t, tlsVersions, tls.VersionTLS11, "TLS 1.1")
+	testEnumToString(t, tlsVersions, tls.VersionTLS12, "TLS 1.2")
+	testEnumToString(t, tlsVersions, tls.VersionTLS13, "TLS 1.3")
+	testEnumToString(t, tlsVersions, 0x0300, "UNKNOWN[0x300]")
+}
+
+func TestTLSCipherSuiteStrings(t *testing.T) {
+	testEnumToString(t, tlsCipherSuites, tls.TLS_AES_128_GCM_SHA256, "TLS_AES_128_GCM_SHA256")
+	testEnumToString(t, tlsCipherSuites, tls.TLS_AES_256_GCM_SHA384, "TLS_AES_256_GCM_SHA384")
+	testEnumToString(t, tlsCipherSuites, tls.TLS_CHACHA20_POLY1305_SHA256, "TLS_CHACHA20_POLY1305_SHA256")
+	testEnumToString(t, tlsCipherSuites, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305, "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256")
+	testEnumToString(t, tlsCipherSuites, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	testEnumToString(t, tlsCipherSuites, 0xffff, "UNKNOWN[0xffff]")
+}
+
+func TestTLSCipherSuiteNamesMatchGo(t *testing.T) {
+	for id, name := range tlsCipherSuites {
+		if want := tls.CipherSuiteName(id); name != want {
+			t.Errorf("tlsCipherSuites[0x%x]: want %q got %q", id, want, name)
+		}
+	}
+}
+
+func TestTouchUpReportErrorsAreSerialised(t *testing.T) {
+	report := ServerReport{
+		WellKnownResult:  &WellKnownResult{Error: errors.New("well-known failed")},
+		ConnectionErrors: map[string]error{"1.2.3.4:8448": errors.New("connection failed")},
+		ConnectionReports: map[string]ConnectionReport{"5.6.7.8:8448": {
+			ChainError:      errors.New("chain failed"),
+			Version:         VersionReport{Error: errors.New("version failed")},
+			SignatureChecks: map[string]SignatureCheck{"ed25519:a": {Error: errors.New("signature failed")}},
+		}},
+	}
+	report.touchUpReport()
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"well-known failed", "connection failed", "chain failed", "version failed", "signature failed"} {
+		if !strings.Contains(string(encoded), want) {
+			t.Errorf("touchUpReport: want %q in the JSON got %s", want, encoded)
+		}
+	}
+	if strings.Contains(string(encoded), "{}") {
+		t.Errorf("touchUpReport: want no error serialised as {} got %s", encoded)
+	}
+}
+
+func TestTouchUpErrorsNested(t *testing.T) {
+	type nested struct {
+		Err  error
+		Errs []error
+	}
+	value := struct {
+		Ptr *nested
+		Map map[string][]nested
+	}{
+		Ptr: &nested{Err: errors.New("pointer")},
+		Map: map[string][]nested{"a": {{Errs: []error{errors.New("map"), nil}}}},
+	}
+	if !touchUpErrors(reflect.ValueOf(&value).Elem()) {
+		t.Errorf("touchUpErrors: want the errors to be replaced")
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Ptr":{"Err":{"Message":"pointer"},"Errs":null},"Map":{"a":[{"Err":null,"Errs":[{"Message":"map"},null]}]}}`; string(encoded) != want {
+		t.Errorf("touchUpErrors: want %s got %s", want, encoded)
+	}
+	if touchUpErrors(reflect.ValueOf(&value).Elem()) {
+		t.Errorf("touchUpErrors: want nothing replaced the second time")
+	}
+}
+
+func testCompareVersions(t *testing.T, a, b string, want int) {
+	if got := compareVersions(a, b); got != want {
+		t.Errorf("compareVersions(%q, %q): want %d got %d", a, b, want, got)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	testCompareVersions(t, "1.98.0", "1.0.0", 1)
+	testCompareVersions(t, "0.99.5.2", "1.0.0", -1)
+	testCompareVersions(t, "1.0", "1.0.0", 0)
+	testCompareVersions(t, "1.0.0rc3 (b=develop)", "1.0.0", 0)
+	testCompareVersions(t, "v1.2.0", "1.10.0", -1)
+}
+
+func TestTouchUpReportAddressesSorted(t *testing.T) {
+	report := ServerReport{
+		ConnectionReports: map[string]ConnectionReport{"5.6.7.8:8448": {}, "1.2.3.4:8448": {}},
+		ConnectionErrors:  map[string]error{"3.4.5.6:8448": errors.New("connection failed")},
+	}
+	report.touchUpReport()
+	var got []string
+	for _, result := range report.Addresses {
+		got = append(got, result.Address)
+		if (result.Report == nil) == (result.Error == nil) {
+			t.Errorf("Addresses[%q]: want either a report or an error got %#v", result.Address, result)
+		}
+	}
+	if want := []string{"1.2.3.4:8448", "3.4.5.6:8448", "5.6.7.8:8448"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Addresses: want %q got %q", want, got)
+	}
+}
+
+func TestSetCacheHeaders(t *testing.T) {
+	now := time.Now()
+	recorder := httptest.NewRecorder()
+	setCacheHeaders(recorder, &ServerReport{GeneratedAt: now.Add(-reportCacheTTL / 2)}, now)
+	if got, want := recorder.Header().Get("Cache-Control"), fmt.Sprintf("public, max-age=%d", int(reportCacheTTL/2/time.Second)); got != want {
+		t.Errorf("Cache-Control: want %q got %q", want, got)
+	}
+	recorder = httptest.NewRecorder()
+	setCacheHeaders(recorder, &ServerReport{GeneratedAt: now.Add(-reportCacheTTL)}, now)
+	if got := recorder.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control: want %q got %q", "no-cache", got)
+	}
+}
+
+func testEncodeReportPretty(t *testing.T, query string, wantPretty bool) {
+	request, err := parseReportRequest(httptest.NewRequest("GET", "/api/report?server_name=example.com"+query, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := ServerReport{ServerName: "example.com"}
+	report.touchUpReport()
+	encoded, err := encodeReport(&report, request.pretty())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pretty := strings.Contains(string(encoded), "\n"); pretty != wantPretty {
+		t.Errorf("encodeReport with %q: want pretty %v got %s", query, wantPretty, encoded)
+	}
+}
+
+func TestEncodeReportPretty(t *testing.T) {
+	testEncodeReportPretty(t, "", true)
+	testEncodeReportPretty(t, "&pretty=true", true)
+	testEncodeReportPretty(t, "&pretty=false", false)
+	testEncodeReportPretty(t, "&pretty=0", false)
+	if _, err := parseReportRequest(httptest.NewRequest("GET", "/api/report?server_name=example.com&pretty=no", nil)); err == nil {
+		t.Errorf("parseReportRequest: want an error for pretty=no got nil")
+	}
+}
+
+func TestValidateBindAddress(t *testing.T) {
+	for _, addr := range []string{":8080", "127.0.0.1:8080", "[::1]:8080", "localhost:http"} {
+		if err := validateBindAddress(addr); err != nil {
+			t.Errorf("validateBindAddress(%q): want nil got %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"", "8080", "localhost", "127.0.0.1:", ":99999", ":nope"} {
+		if err := validateBindAddress(addr); err == nil {
+			t.Errorf("validateBindAddress(%q): want an error got nil", addr)
+		}
+	}
+}
+
+func TestPprofNotOnAPIMux(t *testing.T) {
+	req := httptest.NewRequest("GET", "/debug/pprof/", nil)
+	if _, pattern := newAPIMux().Handler(req); pattern != "" {
+		t.Errorf("newAPIMux: want no handler for /debug/pprof/ got %q", pattern)
+	}
+	recorder := httptest.NewRecorder()
+	newPprofMux().ServeHTTP(recorder, req)
+	if recorder.Code != 200 {
+		t.Errorf("newPprofMux: want 200 for /debug/pprof/ got %d", recorder.Code)
+	}
+}
+
+func TestBatchRequestDuplicateServers(t *testing.T) {
+	batch := BatchRequest{Servers: []ReportRequest{{ServerName: "example.com"}, {ServerName: "Example.com", TLSSNI: "matrix.example.com"}}}
+	if err := batch.validate(); err == nil {
+		t.Errorf("validate: want an error for a server listed twice got nil")
+	}
+	batch = BatchRequest{Servers: []ReportRequest{{ServerName: "example.com"}, {ServerName: "example.org"}}}
+	if err := batch.validate(); err != nil {
+		t.Errorf("validate: want no error for different servers got %v", err)
+	}
+}
+
+func TestRateLimiterChargesPerReport(t *testing.T) {
+	var limiter rateLimiter
+	now := time.Now()
+	if ok, _ := limiter.allow("1.2.3.4", rateLimitBurst+5, now); !ok {
+		t.Fatalf("allow: want a batch bigger than the burst allowed with a full bucket")
+	}
+	ok, retryAfter := limiter.allow("1.2.3.4", 1, now)
+	if ok {
+		t.Fatalf("allow: want the next request refused while the bucket is in debt")
+	}
+	perToken := time.Minute / time.Duration(rateLimitPerMinute)
+	if want := 6 * perToken; retryAfter < want-time.Second || retryAfter > want+time.Second {
+		t.Errorf("allow: want to retry after about %v got %v", want, retryAfter)
+	}
+	if ok, _ := limiter.allow("5.6.7.8", 1, now); !ok {
+		t.Errorf("allow: want other clients unaffected")
+	}
+}
+
+func TestCachedReportInFlightLimit(t *testing.T) {
+	defer func(saved chan struct{}) { inFlight = saved }(inFlight)
+	inFlight = make(chan struct{}, 1)
+	inFlight <- struct{}{}
+	if _, err := cachedReport(context.Background(), ReportRequest{ServerName: "example.com", NoCache: true}); err != errTooManyReports {
+		t.Errorf("cachedReport: want errTooManyReports with every slot taken got %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	HandleReport(recorder, httptest.NewRequest("GET", "/api/report?server_name=example.com&no_cache=1", nil))
+	if recorder.Code != 503 || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("HandleReport: want a 503 with a Retry-After with every slot taken got %d %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+}
+
+// counterValue returns the value of a counter for the given label value.
+func counterValue(t *testing.T, counter *prometheus.CounterVec, label string) float64 {
+	var metric dto.Metric
+	if err := counter.WithLabelValues(label).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestRecordReportMetricsResults(t *testing.T) {
+	fails, dnsOutcomes := counterValue(t, reportsTotal, "fail"), counterValue(t, reportsByResult, outcomeDNS)
+	recordReportMetrics(&ServerReport{}, nil, time.Second)
+	if got := counterValue(t, reportsTotal, "fail"); got != fails+1 {
+		t.Errorf("federation_reports_total{result=\"fail\"}: want %v got %v", fails+1, got)
+	}
+	if got := counterValue(t, reportsByResult, outcomeDNS); got != dnsOutcomes+1 {
+		t.Errorf("reports_by_result_total{result=\"dns\"}: want %v got %v", dnsOutcomes+1, got)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+var (
+	reportsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federation_reports_total",
+		Help: "Number of reports generated, by result: \"ok\" if federation is OK, \"fail\" if it isn't, \"error\" if the report couldn't be generated and \"cancelled\" if the request was cancelled.",
+	}, []string{"result"})
+	reportsByResult = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reports_by_result_total",
+		Help: "Number of reports by outcome: \"ok\", the first stage that failed (\"dns\", \"connect\", \"tls\", \"keys\" or \"version\") or \"cancelled\".",
+	}, []string{"result"})
+	reportDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "federation_report_duration_seconds",
+		Help:    "Time taken to generate a report, by the same outcomes as reports_by_result_total.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"result"})
+	stageFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federation_stage_failures_total",
+		Help: "Number of failures by stage: \"dns\", \"connect\", \"tls_handshake\", \"key_fetch\" or \"key_checks\".",
+	}, []string{"stage"})
+	inFlightGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "federation_requests_in_flight",
+		Help: "Number of reports currently being generated, including each server in a batch.",
+	})
+	reportCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "federation_report_cache_hits_total",
+		Help: "Number of requests for a report that were served from the report cache.",
+	})
+	reportCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "federation_report_cache_misses_total",
+		Help: "Number of requests for a report that looked in the report cache and had to generate a new report, excluding no_cache requests.",
+	})
+	reportCacheSize = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "federation_report_cache_entries",
+		Help: "Number of reports currently held in the report cache, including expired reports that haven't been swept out yet.",
+	}, func() float64 { return float64(reports.size()) })
+)
+
+// The outcomes of a report used as the "result" label of reportsByResult and reportDuration.
+// The label values must only ever come from this fixed set, never from user
+// input such as the server name, so that the number of time series is bounded.
+const (
+	outcomeOK        = "ok"        // Federation is OK and the version was reported.
+	outcomeDNS       = "dns"       // The server couldn't be resolved.
+	outcomeConnect   = "connect"   // No address accepted a TCP connection.
+	outcomeTLS       = "tls"       // No address completed a TLS handshake.
+	outcomeKeys      = "keys"      // The keys couldn't be fetched or failed their checks.
+	outcomeVersion   = "version"   // Federation is OK but the version couldn't be fetched.
+	outcomeCancelled = "cancelled" // The request was cancelled before the report finished.
+)
+
+// registerMetrics registers the federation metrics with prometheus.
+func registerMetrics() {
+	prometheus.MustRegister(reportsTotal, reportsByResult, reportDuration, stageFailuresTotal, inFlightGauge,
+		reportCacheHits, reportCacheMisses, reportCacheSize)
+}
+
+// recordReportMetrics records the outcome of generating a report.
+// The report is nil if err is not nil.
+func recordReportMetrics(report *ServerReport, err error, duration time.Duration) {
+	outcome := reportOutcome(report, err)
+	reportsByResult.WithLabelValues(outcome).Inc()
+	reportDuration.WithLabelValues(outcome).Observe(duration.Seconds())
+	if err == errReportCancelled {
+		reportsTotal.WithLabelValues("cancelled").Inc()
+		return
+	}
+	if err != nil {
+		reportsTotal.WithLabelValues("error").Inc()
+		stageFailuresTotal.WithLabelValues(stageDNS).Inc()
+		return
+	}
+	if report.FederationOK {
+		reportsTotal.WithLabelValues("ok").Inc()
+	} else {
+		reportsTotal.WithLabelValues("fail").Inc()
+	}
+	if len(report.DNSResult.Addrs) == 0 {
+		stageFailuresTotal.WithLabelValues(stageDNS).Inc()
+	}
+	for _, err := range report.ConnectionErrors {
+		if !wasProbed(err) {
+			continue
+		}
+		stageFailuresTotal.WithLabelValues(errorStage(err)).Inc()
+	}
+	for _, connReport := range report.ConnectionReports {
+		if len(connReport.FailedChecks) > 0 {
+			stageFailuresTotal.WithLabelValues(stageKeyChecks).Inc()
+		}
+	}
+}
+
+// reportOutcome returns the outcome of a report for reportsByResult and reportDuration.
+// The report is nil if err is not nil.
+func reportOutcome(report *ServerReport, err error) string {
+	switch {
+	case err == errReportCancelled:
+		return outcomeCancelled
+	case err != nil || len(report.DNSResult.Addrs) == 0:
+		return outcomeDNS
+	case len(report.ConnectionReports) == 0:
+		return connectionOutcome(report.ConnectionErrors)
+	case !report.FederationOK:
+		return outcomeKeys
+	}
+	for _, connReport := range report.ConnectionReports {
+		if connReport.Version.Error != nil && !connReport.Version.TimedOut {
+			return outcomeVersion
+		}
+	}
+	return outcomeOK
+}
+
+// connectionOutcome returns the outcome when none of the addresses connected,
+// which is the furthest stage that any of them reached before failing.
+func connectionOutcome(errs map[string]error) string {
+	outcome := outcomeConnect
+	for _, err := range errs {
+		if !wasProbed(err) {
+			continue
+		}
+		switch errorStage(err) {
+		case stageKeyFetch:
+			return outcomeKeys
+		case stageTLSHandshake:
+			outcome = outcomeTLS
+		}
+	}
+	return outcome
+}
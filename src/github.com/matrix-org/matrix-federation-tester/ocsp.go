@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/crypto/ocsp"
+	"time"
+)
+
+// The OCSPStatus of a connection.
+const (
+	ocspGood    = "good"    // The stapled response says the leaf certificate hasn't been revoked.
+	ocspRevoked = "revoked" // The stapled response says the leaf certificate has been revoked.
+	ocspUnknown = "unknown" // The responder doesn't know the certificate, or the stapled response couldn't be verified.
+	ocspNone    = "none"    // The server didn't staple an OCSP response.
+)
+
+// checkOCSPStaple checks the OCSP response stapled to the TLS handshake, if any,
+// against the leaf certificate and its issuer, which is the next certificate in the chain.
+// Returns the status and why the response couldn't be verified if it couldn't.
+func checkOCSPStaple(staple []byte, certs []*x509.Certificate, now time.Time) (string, error) {
+	if len(staple) == 0 {
+		return ocspNone, nil
+	}
+	if len(certs) < 2 {
+		return ocspUnknown, fmt.Errorf("ocsp: the server didn't send the issuer of its certificate to verify the stapled response with")
+	}
+	response, err := ocsp.ParseResponseForCert(staple, certs[0], certs[1])
+	if err != nil {
+		return ocspUnknown, err
+	}
+	if !response.NextUpdate.IsZero() && now.After(response.NextUpdate) {
+		return ocspUnknown, fmt.Errorf("ocsp: the stapled response expired at %s", response.NextUpdate.UTC().Format(time.RFC3339))
+	}
+	switch response.Status {
+	case ocsp.Good:
+		return ocspGood, nil
+	case ocsp.Revoked:
+		return ocspRevoked, nil
+	}
+	return ocspUnknown, nil
+}
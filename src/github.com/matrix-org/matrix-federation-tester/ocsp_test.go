@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"golang.org/x/crypto/ocsp"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// createTestChain creates a leaf certificate for matrix.example.com issued by a test CA.
+// Returns the chain as served, leaf first, and the key of the CA.
+func createTestChain(t *testing.T) ([]*x509.Certificate, crypto.Signer) {
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "matrix.example.com"},
+		DNSNames:     []string{"matrix.example.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(30 * 24 * time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &leafTemplate, ca, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*x509.Certificate{leaf, ca}, caKey
+}
+
+// createTestStaple creates an OCSP response for the leaf of the chain signed by the key of its issuer.
+func createTestStaple(t *testing.T, chain []*x509.Certificate, caKey crypto.Signer, status int, nextUpdate time.Time) []byte {
+	template := ocsp.Response{
+		Status:       status,
+		SerialNumber: chain[0].SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   nextUpdate,
+	}
+	if status == ocsp.Revoked {
+		template.RevokedAt = time.Now().Add(-time.Hour)
+	}
+	staple, err := ocsp.CreateResponse(chain[1], chain[1], template, caKey)
+	if err != nil {
+		t.Fatalf("ocsp.CreateResponse: %v", err)
+	}
+	return staple
+}
+
+func testOCSPStaple(t *testing.T, staple []byte, chain []*x509.Certificate, wantStatus string, wantError bool) {
+	status, err := checkOCSPStaple(staple, chain, time.Now())
+	if status != wantStatus || (err != nil) != wantError {
+		t.Errorf("checkOCSPStaple: want (%q, error %v) got (%q, %v)", wantStatus, wantError, status, err)
+	}
+}
+
+func TestOCSPStapleNone(t *testing.T) {
+	chain, _ := createTestChain(t)
+	testOCSPStaple(t, nil, chain, ocspNone, false)
+}
+
+func TestOCSPStapleGood(t *testing.T) {
+	chain, caKey := createTestChain(t)
+	staple := createTestStaple(t, chain, caKey, ocsp.Good, time.Now().Add(24*time.Hour))
+	testOCSPStaple(t, staple, chain, ocspGood, false)
+}
+
+func TestOCSPStapleRevoked(t *testing.T) {
+	chain, caKey := createTestChain(t)
+	staple := createTestStaple(t, chain, caKey, ocsp.Revoked, time.Now().Add(24*time.Hour))
+	testOCSPStaple(t, staple, chain, ocspRevoked, false)
+}
+
+func TestOCSPStapleUnknown(t *testing.T) {
+	chain, caKey := createTestChain(t)
+	staple := createTestStaple(t, chain, caKey, ocsp.Unknown, time.Now().Add(24*time.Hour))
+	testOCSPStaple(t, staple, chain, ocspUnknown, false)
+}
+
+func TestOCSPStapleExpired(t *testing.T) {
+	chain, caKey := createTestChain(t)
+	staple := createTestStaple(t, chain, caKey, ocsp.Good, time.Now().Add(-time.Minute))
+	testOCSPStaple(t, staple, chain, ocspUnknown, true)
+}
+
+func TestOCSPStapleWrongIssuer(t *testing.T) {
+	chain, _ := createTestChain(t)
+	otherChain, otherCAKey := createTestChain(t)
+	staple := createTestStaple(t, otherChain, otherCAKey, ocsp.Good, time.Now().Add(24*time.Hour))
+	testOCSPStaple(t, staple, chain, ocspUnknown, true)
+}
+
+func TestOCSPStapleWithoutIssuer(t *testing.T) {
+	chain, caKey := createTestChain(t)
+	staple := createTestStaple(t, chain, caKey, ocsp.Good, time.Now().Add(24*time.Hour))
+	testOCSPStaple(t, staple, chain[:1], ocspUnknown, true)
+}
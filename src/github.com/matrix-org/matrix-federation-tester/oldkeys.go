@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/matrix-org/golang-matrixfederation"
+	"time"
+)
+
+// An OldVerifyKey is a key from the "old_verify_keys" of a server key document.
+// https://matrix.org/docs/spec/server_server/r0.1.0.html#get-matrix-key-v2-server-keyid
+type OldVerifyKey struct {
+	Key       matrixfederation.Base64String // The public key.
+	ExpiredTS uint64                        // When the key stopped being used to sign events, in milliseconds.
+	ExpiredAt time.Time                     // ExpiredTS as a time.
+	Expired   bool                          // ExpiredTS is in the past, as it should be for a rotated key.
+	Signature *SignatureCheck               // The check of the document's signature from this key, or nil if it isn't signed by it.
+}
+
+// summarizeOldVerifyKeys returns the old verify keys of a server key document by key ID.
+// If the document is still signed by an old key then that signature is checked too.
+func summarizeOldVerifyKeys(keys matrixfederation.ServerKeys, now time.Time) map[string]OldVerifyKey {
+	signatures := keySignatures(keys)
+	results := map[string]OldVerifyKey{}
+	for keyID, keyData := range keys.OldVerifyKeys {
+		expiredAt := time.Unix(0, int64(keyData.ExpiredTS)*int64(time.Millisecond)).UTC()
+		old := OldVerifyKey{
+			Key:       keyData.Key,
+			ExpiredTS: keyData.ExpiredTS,
+			ExpiredAt: expiredAt,
+			Expired:   expiredAt.Before(now),
+		}
+		if _, ok := signatures[keyID]; ok {
+			check := checkSignature(keys, keyID, keyData.Key, true)
+			// The key isn't in "verify_keys" even though checkSignature assumes it is.
+			check.HasVerifyKey = false
+			old.Signature = &check
+		}
+		results[keyID] = old
+	}
+	return results
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// enablePprof is whether to serve the profiling endpoints on pprofBindAddress.
+// They aren't served by default since they shouldn't be exposed to the internet.
+// It can be set using the ENABLE_PPROF environment variable.
+var enablePprof = false
+
+// pprofBindAddress is the "[<host>]:<port>" to serve the profiling endpoints on, which is
+// separate from the bindAddress used for the API so that they can't be reached through it.
+// It can be set using the PPROF_BIND_ADDRESS environment variable.
+var pprofBindAddress = "localhost:6060"
+
+// newPprofMux returns a mux serving the profiling endpoints under /debug/pprof/.
+// Importing net/http/pprof also registers them on the default mux, which is why
+// the API is served by newAPIMux instead.
+func newPprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// startPprof serves the profiling endpoints on pprofBindAddress in the background.
+// Exits if the address can't be listened on, like the API server.
+func startPprof() {
+	listener, err := net.Listen("tcp", pprofBindAddress)
+	if err != nil {
+		log.Fatalf("Cannot listen on PPROF_BIND_ADDRESS %q: %v", pprofBindAddress, err)
+	}
+	log.Printf("Serving profiling endpoints on %s", listener.Addr())
+	go func() {
+		log.Fatal(http.Serve(listener, newPprofMux()))
+	}()
+}
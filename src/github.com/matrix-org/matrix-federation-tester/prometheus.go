@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The stages reported by the matrix_federation_stage_ok metric, in the order
+// they are reached. These are the outcomes of reportOutcome other than "ok".
+var prometheusStages = []string{outcomeDNS, outcomeConnect, outcomeTLS, outcomeKeys, outcomeVersion}
+
+// renderPrometheus writes a touched up report as metrics in the prometheus
+// text exposition format, for the node_exporter textfile collector.
+// Every metric has a server_name label. The metric names are part of the API
+// so they mustn't be changed once added.
+func renderPrometheus(w io.Writer, serverName string, report *ServerReport) {
+	server := fmt.Sprintf("server_name=%q", escapeLabel(serverName))
+	writeMetricHeader(w, "matrix_federation_ok", "Whether federation with the server is OK.")
+	fmt.Fprintf(w, "matrix_federation_ok{%s} %d\n", server, boolMetric(report.FederationOK))
+	writeMetricHeader(w, "matrix_federation_score", "The federation health score of the server from 0 to 100.")
+	fmt.Fprintf(w, "matrix_federation_score{%s} %d\n", server, report.Score)
+	writeMetricHeader(w, "matrix_federation_stage_ok", "Whether the stage of checking the server succeeded, stages after the first that failed aren't OK.")
+	outcome := reportOutcome(report, nil)
+	failed := false
+	for _, stage := range prometheusStages {
+		failed = failed || stage == outcome
+		fmt.Fprintf(w, "matrix_federation_stage_ok{%s,stage=%q} %d\n", server, stage, boolMetric(!failed))
+	}
+	writeMetricHeader(w, "matrix_federation_cert_expiry_days", "The number of whole days until the leaf certificate served by the address expires.")
+	for _, addr := range sortedAddrs(report.ConnectionReports) {
+		if certs := report.ConnectionReports[addr].Certificates; len(certs) > 0 {
+			fmt.Fprintf(w, "matrix_federation_cert_expiry_days{%s,address=%q} %d\n", server, escapeLabel(addr), certs[0].DaysUntilExpiry)
+		}
+	}
+	writeMetricHeader(w, "matrix_federation_tls_grade", "Always 1, with the grade of the cipher suite negotiated with the address as the grade label.")
+	for _, addr := range sortedAddrs(report.ConnectionReports) {
+		grade := report.ConnectionReports[addr].Cipher.Grade
+		fmt.Fprintf(w, "matrix_federation_tls_grade{%s,address=%q,grade=%q} 1\n", server, escapeLabel(addr), grade)
+	}
+	writeMetricHeader(w, "matrix_federation_report_timestamp_seconds", "When the report was generated, as a unix timestamp.")
+	fmt.Fprintf(w, "matrix_federation_report_timestamp_seconds{%s} %d\n", server, report.GeneratedAt.Unix())
+}
+
+// writeMetricHeader writes the HELP and TYPE lines for a gauge.
+func writeMetricHeader(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+// escapeLabel replaces the characters that %q would escape differently from
+// the prometheus text format, so that the result can be quoted using %q.
+// Server names and addresses have already been validated so this is only a precaution.
+func escapeLabel(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// boolMetric returns 1 for true and 0 for false.
+func boolMetric(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// encodeReportPrometheus renders a touched up report as prometheus metrics using renderPrometheus.
+func encodeReportPrometheus(serverName string, report *ServerReport) []byte {
+	var buffer bytes.Buffer
+	renderPrometheus(&buffer, serverName, report)
+	return buffer.Bytes()
+}
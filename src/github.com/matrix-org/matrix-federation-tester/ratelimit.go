@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitPerMinute is how many reports each client IP can ask for from the endpoints that probe servers per minute.
+// It can be set using the RATE_LIMIT_PER_MINUTE environment variable.
+// A limit of zero disables rate limiting.
+var rateLimitPerMinute = 30
+
+// rateLimitBurst is how many reports each client IP can ask for at once before being limited to rateLimitPerMinute.
+// It can be set using the RATE_LIMIT_BURST environment variable.
+var rateLimitBurst = 10
+
+// clients is the rate limiter used by rateLimited.
+var clients rateLimiter
+
+// A rateLimiter limits the rate of reports generated for each client using a token bucket per client.
+// Each bucket holds up to rateLimitBurst tokens and refills at rateLimitPerMinute. Each report costs a token.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// A tokenBucket is the number of reports a client can ask for, as of the time it was last updated.
+// It is negative if the client owes tokens for a request that cost more than it had.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// allow takes cost tokens from the client's bucket if there is at least one token in it.
+// A request can cost more tokens than the bucket has, e.g. a big batch, in which case
+// the bucket goes into debt and the client has to wait for it to refill before the next request.
+// Returns whether the request is allowed and if not how long until the next token.
+// Buckets that have refilled are swept out at most once a minute since they are the same as a new bucket.
+func (l *rateLimiter) allow(client string, cost int, now time.Time) (bool, time.Duration) {
+	perSecond := float64(rateLimitPerMinute) / 60
+	burst := float64(rateLimitBurst)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+	if now.Sub(l.lastSweep) >= time.Minute {
+		for key, bucket := range l.buckets {
+			if bucket.tokens+now.Sub(bucket.updated).Seconds()*perSecond >= burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	bucket := l.buckets[client]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*perSecond)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+	}
+	bucket.tokens -= float64(cost)
+	return true, 0
+}
+
+// rateLimited wraps a handler for an endpoint that generates a single report so that each
+// client IP can only make rateLimitPerMinute requests to it.
+// Requests over the limit get a 429 with a Retry-After header.
+// CORS preflight requests aren't limited since they don't probe anything.
+// Endpoints that generate several reports per request call rateLimitReports themselves instead.
+func rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "OPTIONS" && !rateLimitReports(w, req, 1) {
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// rateLimitReports charges the client IP a token for each of the reports a request will generate.
+// If the client is over the limit then it writes a 429 with a Retry-After header and returns false.
+func rateLimitReports(w http.ResponseWriter, req *http.Request, reports int) bool {
+	if rateLimitPerMinute <= 0 || reports == 0 {
+		return true
+	}
+	ok, retryAfter := clients.allow(clientIP(req), reports, time.Now())
+	if !ok {
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeJSONError(w, 429, fmt.Errorf("Too many requests, try again in %d seconds", seconds))
+	}
+	return ok
+}
+
+// clientIP returns the IP address the request came from.
+// Headers like X-Forwarded-For are ignored since they can be set by the client.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The maximum number of bytes we will read from a request body.
+const maxRequestBytes = 64 * 1024
+
+// A ReportRequest is a request for a report on a matrix server.
+// It is either read from the query parameters of a GET or the JSON body of a POST.
+type ReportRequest struct {
+	ServerName      string `json:"server_name"`      // The name of the matrix server to report on.
+	TLSSNI          string `json:"tls_sni"`          // The TLS SNI to send, or a comma separated list of them, see parseSNIs. Empty to use the name of the server we connect to.
+	Timeout         int    `json:"timeout"`          // The time allowed to probe each address in seconds, or 0 for the default.
+	NoCache         bool   `json:"no_cache"`         // Generate a fresh report rather than using a cached one.
+	Format          string `json:"format"`           // The format of the response, "json", "text" or "prometheus". Defaults to "json".
+	KeyServerName   string `json:"key_server_name"`  // The server name to validate the keys against, or empty to use the requested server name.
+	TargetAddr      string `json:"target_addr"`      // The "<ip>:<port>" to connect to instead of resolving the server name, or empty to resolve it.
+	SkipChecks      string `json:"skip_checks"`      // A comma separated list of the checks that don't count towards the verdict, see verdictChecks.
+	CheckResumption bool   `json:"check_resumption"` // Also check whether each address supports TLS session resumption, see checkResumption.
+	At              string `json:"at"`               // The RFC 3339 time to check the validity of the keys and certificates at, or empty for the current time.
+	Pretty          *bool  `json:"pretty"`           // Whether JSON reports are indented, or nil for the default, see pretty.
+}
+
+// The formats a report can be returned in.
+const (
+	formatJSON       = "json"       // Indented JSON.
+	formatText       = "text"       // Line oriented plain text, see renderText.
+	formatPrometheus = "prometheus" // Prometheus metrics, see renderPrometheus.
+	formatLegacy     = "legacy"     // JSON in the shape returned by the reference federation tester, see toLegacyReport.
+)
+
+// cacheKey returns the key for caching the report for this request.
+// It leaves out the fields that don't change the report generated.
+func (r ReportRequest) cacheKey() ReportRequest {
+	r.NoCache = false
+	r.Format = ""
+	r.Pretty = nil
+	return r
+}
+
+// options returns the reportOptions for this request.
+func (r *ReportRequest) options() reportOptions {
+	// The skip list has already been validated and normalized by validate.
+	skipChecks, _ := parseSkipChecks(r.SkipChecks)
+	var extraSNIs []string
+	if snis, _ := parseSNIs(r.TLSSNI); len(snis) > 1 {
+		extraSNIs = snis[1:]
+	}
+	// The time has already been validated by validate.
+	at, _ := parseAt(r.At)
+	return reportOptions{keyServerName: r.KeyServerName, targetAddr: r.TargetAddr, skipChecks: skipChecks, freshDNS: r.NoCache, checkResumption: r.CheckResumption, extraSNIs: extraSNIs, at: at}
+}
+
+// sni returns the TLS SNI to send for the full probe of each address, which is the first one if the request lists several.
+func (r *ReportRequest) sni() string {
+	if snis, _ := parseSNIs(r.TLSSNI); len(snis) > 0 {
+		return snis[0]
+	}
+	return ""
+}
+
+// maxSNIValues is the most TLS SNIs a request can list, since each of them is a handshake with every address.
+const maxSNIValues = 5
+
+// parseSNIs splits a comma separated list of TLS SNIs, ignoring empty and repeated values.
+// Returns an error if there are more than maxSNIValues.
+func parseSNIs(list string) ([]string, error) {
+	seen := map[string]bool{}
+	var snis []string
+	for _, sni := range strings.Split(list, ",") {
+		sni = strings.TrimSpace(sni)
+		if sni == "" || seen[sni] {
+			continue
+		}
+		seen[sni] = true
+		snis = append(snis, sni)
+	}
+	if len(snis) > maxSNIValues {
+		return nil, fmt.Errorf("Too many values in tls_sni: %d, the most is %d", len(snis), maxSNIValues)
+	}
+	return snis, nil
+}
+
+// parseAt parses the RFC 3339 time given in the at parameter.
+// Returns the zero time if the parameter is empty.
+func parseAt(at string) (time.Time, error) {
+	if at == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid at %q: must be an RFC 3339 time like 2006-01-02T15:04:05Z", at)
+	}
+	return parsed.UTC(), nil
+}
+
+// pretty returns whether to indent a JSON report. Reports are indented unless
+// the request opts out, since they are often read by people in a browser.
+func (r *ReportRequest) pretty() bool {
+	return r.Pretty == nil || *r.Pretty
+}
+
+// maxTimeoutSeconds is the longest timeout a request can ask for, so that a
+// client can't hold connections and in-flight slots open for as long as it likes.
+const maxTimeoutSeconds = 60
+
+// timeout returns the time allowed to probe each address.
+func (r *ReportRequest) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return connectionTimeout
+	}
+	return time.Duration(r.Timeout) * time.Second
+}
+
+// parseReportRequest reads a ReportRequest from a HTTP request.
+// GET requests use the query parameters, POST requests must have a JSON body.
+func parseReportRequest(req *http.Request) (*ReportRequest, error) {
+	var request ReportRequest
+	if req.Method == "POST" {
+		if err := decodeJSONBody(req, &request); err != nil {
+			return nil, err
+		}
+	} else {
+		query := req.URL.Query()
+		request.ServerName = query.Get("server_name")
+		request.TLSSNI = query.Get("tls_sni")
+		if timeoutStr := query.Get("timeout"); timeoutStr != "" {
+			seconds, err := strconv.Atoi(timeoutStr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid timeout: %q", timeoutStr)
+			}
+			request.Timeout = seconds
+		}
+		request.NoCache = query.Get("no_cache") == "1"
+		request.Format = query.Get("format")
+		request.KeyServerName = query.Get("key_server_name")
+		request.TargetAddr = query.Get("target_addr")
+		request.SkipChecks = query.Get("skip_checks")
+		request.CheckResumption = query.Get("check_resumption") == "1"
+		request.At = query.Get("at")
+		if prettyStr := query.Get("pretty"); prettyStr != "" {
+			pretty, err := strconv.ParseBool(prettyStr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pretty: %q", prettyStr)
+			}
+			request.Pretty = &pretty
+		}
+	}
+	if request.Format == "" {
+		request.Format = formatJSON
+		if mediaType, _, err := mime.ParseMediaType(req.Header.Get("Accept")); err == nil && mediaType == "text/plain" {
+			request.Format = formatText
+		}
+	}
+	if err := request.validate(); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// parseFormatlessReportRequest reads a ReportRequest from the query parameters of a
+// GET request for an endpoint that always responds in the same format, like /report.
+// Any format parameter is ignored rather than validated since it doesn't apply.
+func parseFormatlessReportRequest(req *http.Request) (*ReportRequest, error) {
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	query.Del("format")
+	req.URL.RawQuery = query.Encode()
+	return parseReportRequest(req)
+}
+
+// validate checks that the request has a valid server name, timeout and format.
+// The server names are normalized using normalizeServerName.
+func (r *ReportRequest) validate() error {
+	serverName, err := normalizeServerName(r.ServerName)
+	if err != nil {
+		return err
+	}
+	r.ServerName = serverName
+	if r.Timeout < 0 {
+		return fmt.Errorf("Invalid timeout: %d", r.Timeout)
+	}
+	if r.Timeout > maxTimeoutSeconds {
+		return fmt.Errorf("Invalid timeout: %d, the most is %d", r.Timeout, maxTimeoutSeconds)
+	}
+	if r.Format != "" && r.Format != formatJSON && r.Format != formatText && r.Format != formatPrometheus && r.Format != formatLegacy {
+		return fmt.Errorf("Invalid format: %q", r.Format)
+	}
+	if r.KeyServerName != "" {
+		if r.KeyServerName, err = normalizeServerName(r.KeyServerName); err != nil {
+			return fmt.Errorf("Invalid key_server_name: %v", err)
+		}
+	}
+	if r.TargetAddr != "" {
+		if err = validateTargetAddr(r.TargetAddr); err != nil {
+			return err
+		}
+	}
+	snis, err := parseSNIs(r.TLSSNI)
+	if err != nil {
+		return err
+	}
+	r.TLSSNI = strings.Join(snis, ",")
+	// Normalize the skip list so that equivalent lists share a cache entry.
+	skipChecks, err := parseSkipChecks(r.SkipChecks)
+	if err != nil {
+		return err
+	}
+	r.SkipChecks = strings.Join(skipChecks, ",")
+	// Normalize the time to UTC so that the same time shares a cache entry.
+	at, err := parseAt(r.At)
+	if err != nil {
+		return err
+	}
+	if !at.IsZero() {
+		r.At = at.Format(time.RFC3339Nano)
+	}
+	return nil
+}
+
+// validateTargetAddr checks that a target_addr is an "<ip>:<port>".
+func validateTargetAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("Invalid target_addr %q: %v", addr, err)
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("Invalid target_addr %q: %q is not an IP address", addr, host)
+	}
+	if portNumber, convErr := strconv.Atoi(port); convErr != nil || portNumber < 1 || portNumber > 65535 {
+		return fmt.Errorf("Invalid target_addr %q: invalid port %q", addr, port)
+	}
+	return nil
+}
+
+// decodeJSONBody decodes the JSON body of a POST request into v.
+func decodeJSONBody(req *http.Request, v interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return fmt.Errorf("POST requests must have a Content-Type of application/json")
+	}
+	decoder := json.NewDecoder(io.LimitReader(req.Body, maxRequestBytes))
+	if err = decoder.Decode(v); err != nil {
+		return fmt.Errorf("Malformed JSON body: %v", err)
+	}
+	return nil
+}
+
+// How long browsers may cache the response to a CORS preflight request, in seconds.
+const corsMaxAge = "86400"
+
+// setCORSHeaders sets Access-Control headers allowing any origin so that the
+// API can be used by web apps running in browsers.
+// The methods are the methods the endpoint supports, not including OPTIONS.
+func setCORSHeaders(w http.ResponseWriter, methods string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", methods+", OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+	w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+}
+
+// An ErrorResponse is the JSON body returned when a request fails.
+type ErrorResponse struct {
+	Error ReportError // The reason the request failed.
+}
+
+// writeJSONError writes a JSON ErrorResponse for err with the given HTTP status code.
+// Errors mustn't be cached since the next request may well succeed.
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	encoded, _ := json.Marshal(ErrorResponse{toReportError(err, "")})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(encoded)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/matrix-org/golang-matrixfederation"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The port used for federation if a server doesn't specify one.
+const defaultFederationPort = "8448"
+
+// hasExplicitPort returns true if the server name ends with an explicit port.
+func hasExplicitPort(serverName string) bool {
+	if strings.HasPrefix(serverName, "[") {
+		// Bracketed IPv6 literal, e.g. "[::1]" or "[::1]:8448".
+		return strings.Contains(serverName, "]:")
+	}
+	return strings.Contains(serverName, ":")
+}
+
+// hostOf returns the host part of a "<host>[:<port>]" server name without any IPv6 brackets.
+func hostOf(serverName string) string {
+	if host, _, err := net.SplitHostPort(serverName); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(serverName, "["), "]")
+}
+
+// isIPLiteral returns true if the host part of the server name is an IP address.
+func isIPLiteral(serverName string) bool {
+	return net.ParseIP(hostOf(serverName)) != nil
+}
+
+// lookupName returns the name to pass to matrixfederation.LookupServer for a server name.
+// IP literals don't have SRV records so if they don't have an explicit port then the default port is added.
+func lookupName(serverName string) string {
+	if !hasExplicitPort(serverName) && isIPLiteral(serverName) {
+		return net.JoinHostPort(hostOf(serverName), defaultFederationPort)
+	}
+	return serverName
+}
+
+// dnsLookupAttempts is the number of times a DNS lookup that fails with a retryable error is attempted.
+// It can be set using the DNS_LOOKUP_ATTEMPTS environment variable.
+var dnsLookupAttempts = 2
+
+// The time waited before the first DNS retry. It doubles for each retry after that.
+const dnsRetryBackoff = 250 * time.Millisecond
+
+// lookupServer calls matrixfederation.LookupServer, retrying up to
+// dnsLookupAttempts times with exponential backoff if the lookup fails with a
+// timeout or a temporary error such as SERVFAIL. Names that don't exist aren't retried.
+// Returns the result and the number of attempts made.
+// LookupServer can't be cancelled, so the context is only checked between attempts.
+func lookupServer(ctx context.Context, serverName string) (*matrixfederation.DNSResult, int, error) {
+	backoff := dnsRetryBackoff
+	for attempt := 1; ; attempt++ {
+		result, err := matrixfederation.LookupServer(serverName)
+		if ctx.Err() != nil {
+			return nil, attempt, errReportCancelled
+		}
+		if attempt >= dnsLookupAttempts || !shouldRetryLookup(result, err) {
+			return result, attempt, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, attempt, errReportCancelled
+		}
+		backoff *= 2
+	}
+}
+
+// shouldRetryLookup returns true if a DNS lookup failed in a way that retrying might fix.
+// That is if the lookup failed with a retryable error, or found no addresses
+// because looking up one of the hosts failed with a retryable error.
+func shouldRetryLookup(result *matrixfederation.DNSResult, err error) bool {
+	if err != nil {
+		return isRetryableDNSError(err)
+	}
+	if len(result.Addrs) > 0 {
+		return false
+	}
+	if isRetryableDNSError(result.SRVError) {
+		return true
+	}
+	for _, host := range result.Hosts {
+		if isRetryableDNSError(host.Error) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRetryableDNSError returns true if err is a DNS timeout or temporary failure.
+func isRetryableDNSError(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && !dnsErr.IsNotFound && (dnsErr.IsTimeout || dnsErr.IsTemporary)
+}
+
+// resolutionSteps describes how the server name was resolved to the addresses
+// in the report, in the order of the spec: an explicit port or IP literal,
+// then .well-known delegation, then SRV records, then the default port.
+// connectName is the name that was looked up in DNS.
+func (report *ServerReport) resolutionSteps(serverName, connectName string) []string {
+	var steps []string
+	if step := report.serverNameStep(serverName); step != "" {
+		steps = append(steps, step)
+	}
+	if connectName != serverName && isIPLiteral(connectName) {
+		steps = append(steps, fmt.Sprintf("delegation: IP literal -> %s", lookupName(connectName)))
+	} else if connectName != serverName && report.ExplicitPort {
+		steps = append(steps, fmt.Sprintf("delegation: explicit port -> %s", connectName))
+	} else if !report.ExplicitPort && !isIPLiteral(connectName) {
+		steps = append(steps, report.srvSteps(connectName)...)
+	}
+	if len(report.DNSResult.Addrs) == 0 {
+		return append(steps, "addresses: none")
+	}
+	return append(steps, fmt.Sprintf("addresses: %s", strings.Join(report.DNSResult.Addrs, ", ")))
+}
+
+// serverNameStep describes how the server name itself was handled, either
+// used as it is or delegated using .well-known. Returns "" if .well-known
+// wasn't looked up.
+func (report *ServerReport) serverNameStep(serverName string) string {
+	switch {
+	case isIPLiteral(serverName):
+		return fmt.Sprintf("server name: IP literal -> %s", lookupName(serverName))
+	case hasExplicitPort(serverName):
+		return fmt.Sprintf("server name: explicit port -> %s", serverName)
+	case report.WellKnownResult == nil:
+		return ""
+	case report.WellKnownResult.ServerAddress != "":
+		return fmt.Sprintf("well-known: found -> %s", report.WellKnownResult.ServerAddress)
+	case report.WellKnownResult.Error != nil:
+		return fmt.Sprintf("well-known: failed (%v), using %s", report.WellKnownResult.Error, serverName)
+	}
+	return fmt.Sprintf("well-known: no delegation, using %s", serverName)
+}
+
+// srvSteps describes the SRV lookup for a name without an explicit port,
+// and the fall back to the default port if there weren't any SRV records.
+func (report *ServerReport) srvSteps(connectName string) []string {
+	var steps []string
+	switch {
+	case len(report.DNSResult.SRVRecords) > 0:
+		var targets []string
+		for _, record := range report.DNSResult.SRVRecords {
+			targets = append(targets, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+		}
+		steps = append(steps, fmt.Sprintf("SRV: found -> %s", strings.Join(targets, ", ")))
+	case report.DNSResult.SRVError != nil:
+		steps = append(steps, fmt.Sprintf("SRV: failed (%v)", report.DNSResult.SRVError))
+	default:
+		steps = append(steps, "SRV: none")
+	}
+	if report.UsedDefaultPort {
+		steps = append(steps, fmt.Sprintf("default port: -> %s", net.JoinHostPort(hostOf(connectName), defaultFederationPort)))
+	}
+	return steps
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+)
+
+// checkResumption reports whether the server at addr supports TLS session resumption,
+// which saves a full handshake each time another server reconnects to it.
+// It makes a request over a new connection so that the server can send a session
+// ticket, which in TLS 1.3 arrives after the handshake, then does a second handshake
+// offering that session and checks whether it was resumed.
+// Returns whether it was and how long the resumed handshake took.
+// Connection errors count as not resuming since the probe that generated the report already succeeded,
+// but if there is no time left or the check times out then it returns nil since it couldn't be told.
+// Servers are never offered 0-RTT early data since go doesn't support sending it.
+func checkResumption(ctx context.Context, serverName, addr, sni string, timeout time.Duration) (*bool, time.Duration) {
+	if timeout <= 0 {
+		return nil, 0
+	}
+	config := tlsConfig(sni)
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	start := time.Now()
+	deadline := start.Add(timeout)
+	resumed := false
+	tlsconn, _, err := dialTLSConfig(ctx, addr, config, start, deadline)
+	if err != nil {
+		return resumptionResult(err, &resumed)
+	}
+	tlsconn.SetDeadline(deadline)
+	// Reading the response processes any session tickets sent by the server.
+	_, err = requestDirect(serverName, "/_matrix/federation/v1/version", tlsconn)
+	tlsconn.Close()
+	if err != nil {
+		return resumptionResult(timeoutError(err, timeout), &resumed)
+	}
+	tlsconn, connected, err := dialTLSConfig(ctx, addr, config, time.Now(), deadline)
+	if err != nil {
+		return resumptionResult(err, &resumed)
+	}
+	handshaken := time.Now()
+	defer tlsconn.Close()
+	if !tlsconn.ConnectionState().DidResume {
+		return &resumed, 0
+	}
+	resumed = true
+	return &resumed, handshaken.Sub(connected)
+}
+
+// resumptionResult is the result of checkResumption when a connection or request failed with err:
+// unknown if it timed out, otherwise not resumed.
+func resumptionResult(err error, resumed *bool) (*bool, time.Duration) {
+	if isTimeout(err) {
+		return nil, 0
+	}
+	return resumed, 0
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/golang-matrixfederation"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// HandleSchema handles an HTTP request for the JSON Schema of the reports returned by /api/report.
+// GET /api/schema request.
+func HandleSchema(w http.ResponseWriter, req *http.Request) {
+	setCORSHeaders(w, "GET")
+	if req.Method == "OPTIONS" {
+		return
+	}
+	if req.Method != "GET" {
+		writeJSONError(w, 405, fmt.Errorf("Unsupported method %q", req.Method))
+		return
+	}
+	encoded, err := json.MarshalIndent(reportSchema(), "", "  ")
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.WriteHeader(200)
+	w.Write(encoded)
+}
+
+// A jsonSchema is a JSON Schema document or sub-schema.
+type jsonSchema map[string]interface{}
+
+// reportSchema returns a JSON Schema for a touched up ServerReport.
+// It is generated from the go types so that it can't get out of sync with them.
+// Each struct type is described once under "definitions" and referenced by name.
+func reportSchema() jsonSchema {
+	definitions := map[string]jsonSchema{}
+	root := schemaFor(reflect.TypeOf(ServerReport{}), definitions)
+	root["$schema"] = "http://json-schema.org/draft-07/schema#"
+	root["definitions"] = definitions
+	return root
+}
+
+// Types that are encoded as JSON differently to their go kind.
+var (
+	timeType         = reflect.TypeOf(time.Time{})
+	rawMessageType   = reflect.TypeOf(json.RawMessage{})
+	base64StringType = reflect.TypeOf(matrixfederation.Base64String{})
+	errorType        = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// schemaFor returns the JSON Schema for the JSON encoding of a go type, adding any structs to definitions.
+func schemaFor(t reflect.Type, definitions map[string]jsonSchema) jsonSchema {
+	switch t {
+	case timeType:
+		return jsonSchema{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		// Raw JSON copied from the server, which could be anything.
+		return jsonSchema{}
+	case base64StringType:
+		return jsonSchema{"type": "string", "contentEncoding": "base64"}
+	case errorType:
+		// Errors are touched up into ReportErrors.
+		return nullable(schemaFor(reflect.TypeOf(ReportError{}), definitions))
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Ptr:
+		return nullable(schemaFor(t.Elem(), definitions))
+	case reflect.Slice, reflect.Array:
+		return nullable(jsonSchema{"type": "array", "items": schemaFor(t.Elem(), definitions)})
+	case reflect.Map:
+		return nullable(jsonSchema{"type": "object", "additionalProperties": schemaFor(t.Elem(), definitions)})
+	case reflect.Struct:
+		return structSchema(t, definitions)
+	}
+	// Interfaces other than error could encode as anything.
+	return jsonSchema{}
+}
+
+// structSchema adds the schema for a struct type to definitions and returns a reference to it.
+// Anonymous structs are returned inline.
+func structSchema(t reflect.Type, definitions map[string]jsonSchema) jsonSchema {
+	if t.Name() != "" {
+		ref := jsonSchema{"$ref": "#/definitions/" + t.Name()}
+		if _, ok := definitions[t.Name()]; ok {
+			return ref
+		}
+		// Add a placeholder so that recursive types terminate.
+		definitions[t.Name()] = jsonSchema{}
+		definitions[t.Name()] = structProperties(t, definitions)
+		return ref
+	}
+	return structProperties(t, definitions)
+}
+
+// structProperties returns the object schema for the exported fields of a struct type.
+func structProperties(t reflect.Type, definitions map[string]jsonSchema) jsonSchema {
+	properties := map[string]jsonSchema{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonFieldName(field)
+		if name == "" {
+			continue
+		}
+		properties[name] = schemaFor(field.Type, definitions)
+	}
+	return jsonSchema{"type": "object", "properties": properties}
+}
+
+// jsonFieldName returns the name encoding/json uses for a struct field, or empty if the field isn't encoded.
+func jsonFieldName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// nullable returns a schema that also allows null, since encoding/json encodes nil pointers, slices and maps as null.
+func nullable(schema jsonSchema) jsonSchema {
+	if kind, ok := schema["type"].(string); ok {
+		schema["type"] = []string{kind, "null"}
+		return schema
+	}
+	return jsonSchema{"oneOf": []jsonSchema{schema, {"type": "null"}}}
+}
@@ -0,0 +1,152 @@
+package main
+
+// A ScoreFactor is one of the factors that make up a report's Score.
+type ScoreFactor struct {
+	Name      string // The stable name of the factor, see scoreFactors.
+	Points    int    // The points the server scored for this factor.
+	MaxPoints int    // The most points a server can score for this factor.
+}
+
+// The factors of the score and the most points each is worth. They add up to 100.
+// The weights are documented in the README and shouldn't change between
+// versions, so that historical scores can be compared.
+var scoreFactors = []struct {
+	name      string
+	maxPoints int
+	score     func(report *ServerReport) float64 // Returns the fraction of the points scored.
+}{
+	{"dns", 10, scoreDNS},
+	{"connection", 20, scoreConnection},
+	{"tls_valid", 15, scoreTLSValid},
+	{"tls_modern", 10, scoreTLSModern},
+	{"keys", 25, scoreKeys},
+	{"cert_expiry", 15, scoreCertExpiry},
+	{"version", 5, scoreVersion},
+}
+
+// computeScore sets Score and ScoreFactors from the rest of the report.
+// Factors that depend on a connection score nothing if no address connected.
+func (report *ServerReport) computeScore() {
+	report.Score = 0
+	report.ScoreFactors = nil
+	for _, factor := range scoreFactors {
+		points := int(float64(factor.maxPoints) * factor.score(report))
+		report.Score += points
+		report.ScoreFactors = append(report.ScoreFactors, ScoreFactor{factor.name, points, factor.maxPoints})
+	}
+}
+
+// scoreDNS scores whether the server resolved to at least one address.
+func scoreDNS(report *ServerReport) float64 {
+	return boolScore(len(report.DNSResult.Addrs) > 0)
+}
+
+// scoreConnection scores the fraction of the probed addresses that connected.
+func scoreConnection(report *ServerReport) float64 {
+	probed := len(report.ConnectionReports)
+	for _, err := range report.ConnectionErrors {
+		if wasProbed(err) {
+			probed++
+		}
+	}
+	if probed == 0 {
+		return 0
+	}
+	return float64(len(report.ConnectionReports)) / float64(probed)
+}
+
+// scoreTLSValid scores whether every connection's certificate chain verified.
+// Connections count as valid if chain verification is disabled.
+func scoreTLSValid(report *ServerReport) float64 {
+	return allConnections(report, func(connReport ConnectionReport) bool {
+		return connReport.ChainVerified == nil || *connReport.ChainVerified
+	})
+}
+
+// scoreTLSModern scores the worst cipher grade negotiated: full points for
+// strong, half for acceptable and nothing for anything worse.
+func scoreTLSModern(report *ServerReport) float64 {
+	if len(report.ConnectionReports) == 0 {
+		return 0
+	}
+	worst := 1.0
+	for _, connReport := range report.ConnectionReports {
+		switch connReport.Cipher.Grade {
+		case gradeStrong:
+		case gradeAcceptable:
+			worst = minScore(worst, 0.5)
+		default:
+			worst = 0
+		}
+	}
+	return worst
+}
+
+// scoreKeys scores whether every connection passed the verdictChecks, other than the
+// SkippedChecks, so that the keys are scored the same way as FederationOK.
+func scoreKeys(report *ServerReport) float64 {
+	return allConnections(report, func(connReport ConnectionReport) bool {
+		return len(failedChecks(connReport.Checks, report.SkippedChecks)) == 0
+	})
+}
+
+// scoreCertExpiry scores the headroom before the first leaf certificate expires:
+// full points for 30 days or more, half for 7 days or more, a fifth if it
+// hasn't expired yet and nothing if it has.
+func scoreCertExpiry(report *ServerReport) float64 {
+	if len(report.ConnectionReports) == 0 {
+		return 0
+	}
+	worst := 1.0
+	for _, connReport := range report.ConnectionReports {
+		if len(connReport.Certificates) == 0 {
+			return 0
+		}
+		switch leaf := connReport.Certificates[0]; {
+		case leaf.Expired:
+			return 0
+		case leaf.DaysUntilExpiry < 7:
+			worst = minScore(worst, 0.2)
+		case leaf.DaysUntilExpiry < 30:
+			worst = minScore(worst, 0.5)
+		}
+	}
+	return worst
+}
+
+// scoreVersion scores whether every connection reported a server version.
+// Versions that weren't fetched because the probe ran out of time don't count against it.
+func scoreVersion(report *ServerReport) float64 {
+	return allConnections(report, func(connReport ConnectionReport) bool {
+		return connReport.Version.Error == nil || connReport.Version.TimedOut
+	})
+}
+
+// allConnections returns 1 if at least one address connected and check is true for every connection, 0 otherwise.
+func allConnections(report *ServerReport, check func(ConnectionReport) bool) float64 {
+	if len(report.ConnectionReports) == 0 {
+		return 0
+	}
+	for _, connReport := range report.ConnectionReports {
+		if !check(connReport) {
+			return 0
+		}
+	}
+	return 1
+}
+
+// boolScore returns 1 if ok is true, 0 otherwise.
+func boolScore(ok bool) float64 {
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+// minScore returns the smaller of two scores.
+func minScore(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/idna"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// normalizeServerName cleans up a server name entered by a user.
+// It trims whitespace, strips any URL scheme and trailing slashes,
+// lowercases the host and encodes any internationalized labels as punycode, then checks that what's left is a valid
+// "<host>[:<port>]" server name where the host is a DNS name, an IPv4
+// literal or a bracketed IPv6 literal.
+// https://matrix.org/docs/spec/appendices.html#server-name
+func normalizeServerName(input string) (string, error) {
+	serverName := strings.TrimSpace(input)
+	if i := strings.Index(serverName, "://"); i != -1 {
+		serverName = serverName[i+len("://"):]
+	}
+	if i := strings.Index(serverName, "/"); i != -1 {
+		if strings.Trim(serverName[i:], "/") != "" {
+			return "", fmt.Errorf("Invalid server_name %q: must not contain a path", input)
+		}
+		serverName = serverName[:i]
+	}
+	if serverName == "" {
+		return "", fmt.Errorf("Missing server_name")
+	}
+	host, port := serverName, ""
+	if hasExplicitPort(serverName) {
+		var err error
+		if host, port, err = net.SplitHostPort(serverName); err != nil {
+			return "", fmt.Errorf("Invalid server_name %q: %v", input, err)
+		}
+		var number uint64
+		if number, err = strconv.ParseUint(port, 10, 16); err != nil || number == 0 {
+			return "", fmt.Errorf("Invalid server_name %q: invalid port %q", input, port)
+		}
+		if strings.HasPrefix(serverName, "[") {
+			// SplitHostPort strips the brackets but normalizeHost needs them to tell IPv6 literals apart.
+			host = "[" + host + "]"
+		}
+	}
+	host, err := normalizeHost(host)
+	if err != nil {
+		return "", fmt.Errorf("Invalid server_name %q: %v", input, err)
+	}
+	if port != "" {
+		return net.JoinHostPort(host, port), nil
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]", nil
+	}
+	return host, nil
+}
+
+// normalizeHost lowercases a DNS name and checks that it is either a valid DNS name or an IP literal.
+// Internationalized DNS names are converted to their ASCII form, see toASCIIHost.
+// IPv6 literals may be in brackets. Returns the host without any brackets.
+func normalizeHost(host string) (string, error) {
+	if strings.HasPrefix(host, "[") {
+		if !strings.HasSuffix(host, "]") {
+			return "", fmt.Errorf("missing ']' in IPv6 literal")
+		}
+		host = host[1 : len(host)-1]
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return "", fmt.Errorf("invalid IPv6 literal %q", host)
+		}
+		return host, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil {
+			return "", fmt.Errorf("IPv6 literals must be in brackets")
+		}
+		return host, nil
+	}
+	host, err := toASCIIHost(strings.ToLower(host))
+	if err != nil {
+		return "", err
+	}
+	if len(host) > 255 {
+		return "", fmt.Errorf("host is longer than 255 characters")
+	}
+	for _, c := range host {
+		if !(('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '.') {
+			return "", fmt.Errorf("host contains invalid character %q", c)
+		}
+	}
+	return host, nil
+}
+
+// toASCIIHost converts a DNS name with internationalized labels to its ASCII
+// form using IDNA, e.g. "møller.example" becomes "xn--mller-vua.example", so
+// that it can be looked up in DNS and sent as the TLS SNI.
+// Labels that are already punycode are checked to be valid IDNA.
+// Names that are plain ASCII are returned unchanged.
+func toASCIIHost(host string) (string, error) {
+	if !hasIDNALabel(host) {
+		return host, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid internationalized domain name: %v", err)
+	}
+	return ascii, nil
+}
+
+// hasIDNALabel returns true if the host has a non-ASCII character or a punycode label.
+func hasIDNALabel(host string) bool {
+	for _, c := range host {
+		if c > '~' {
+			return true
+		}
+	}
+	return strings.HasPrefix(host, "xn--") || strings.Contains(host, ".xn--")
+}
+
+// unicodeServerName returns the server name with any punycode labels decoded,
+// or empty if it doesn't have any. The server name must already be normalized.
+func unicodeServerName(serverName string) string {
+	host, port := serverName, ""
+	if hasExplicitPort(serverName) {
+		host, port, _ = net.SplitHostPort(serverName)
+	}
+	if !hasIDNALabel(host) {
+		return ""
+	}
+	unicode, err := idna.ToUnicode(host)
+	if err != nil {
+		return ""
+	}
+	if port != "" {
+		return net.JoinHostPort(unicode, port)
+	}
+	return unicode
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+)
+
+func testNormalizeServerName(t *testing.T, input, want string) {
+	got, err := normalizeServerName(input)
+	if err != nil {
+		t.Errorf("normalizeServerName(%q): unexpected error %v", input, err)
+	} else if got != want {
+		t.Errorf("normalizeServerName(%q): want %q got %q", input, want, got)
+	}
+}
+
+func testNormalizeServerNameFails(t *testing.T, input string) {
+	got, err := normalizeServerName(input)
+	if err == nil {
+		t.Errorf("normalizeServerName(%q): want an error got %q", input, got)
+	}
+}
+
+func TestNormalizeServerName(t *testing.T) {
+	testNormalizeServerName(t, "matrix.org", "matrix.org")
+	testNormalizeServerName(t, "  Matrix.ORG\n", "matrix.org")
+	testNormalizeServerName(t, "matrix.org:8448", "matrix.org:8448")
+}
+
+func TestNormalizeServerNameURLs(t *testing.T) {
+	testNormalizeServerName(t, "https://matrix.org", "matrix.org")
+	testNormalizeServerName(t, "https://matrix.org/", "matrix.org")
+	testNormalizeServerName(t, "http://matrix.org:8448//", "matrix.org:8448")
+	testNormalizeServerNameFails(t, "https://matrix.org/_matrix/key/v2/server")
+}
+
+func TestNormalizeServerNameIPLiterals(t *testing.T) {
+	testNormalizeServerName(t, "1.2.3.4", "1.2.3.4")
+	testNormalizeServerName(t, "1.2.3.4:8449", "1.2.3.4:8449")
+	testNormalizeServerName(t, "[::1]", "[::1]")
+	testNormalizeServerName(t, "[2001:DB8::1]:8448", "[2001:DB8::1]:8448")
+	testNormalizeServerName(t, "https://[::1]:8448/", "[::1]:8448")
+	testNormalizeServerNameFails(t, "::1")
+	testNormalizeServerNameFails(t, "[::1")
+	testNormalizeServerNameFails(t, "[1.2.3.4]")
+	testNormalizeServerNameFails(t, "[not-an-ip]:8448")
+}
+
+func TestNormalizeServerNamePorts(t *testing.T) {
+	testNormalizeServerNameFails(t, "matrix.org:")
+	testNormalizeServerNameFails(t, "matrix.org:0")
+	testNormalizeServerNameFails(t, "matrix.org:65536")
+	testNormalizeServerNameFails(t, "matrix.org:http")
+	testNormalizeServerNameFails(t, "matrix.org:8448:8448")
+}
+
+func TestNormalizeServerNameInvalid(t *testing.T) {
+	testNormalizeServerNameFails(t, "")
+	testNormalizeServerNameFails(t, "   ")
+	testNormalizeServerNameFails(t, "https://")
+	testNormalizeServerNameFails(t, "matrix org")
+	testNormalizeServerNameFails(t, "matrix.org?x=1")
+}
+
+func TestNormalizeServerNameIDNA(t *testing.T) {
+	testNormalizeServerName(t, "møller.example", "xn--mller-vua.example")
+	testNormalizeServerName(t, "MØLLER.example:8448", "xn--mller-vua.example:8448")
+	testNormalizeServerName(t, "matrix.møller.example", "matrix.xn--mller-vua.example")
+	testNormalizeServerName(t, "https://bücher.例え.jp/", "xn--bcher-kva.xn--r8jz45g.jp")
+	testNormalizeServerName(t, "xn--mller-vua.example", "xn--mller-vua.example")
+	// Invalid punycode.
+	testNormalizeServerNameFails(t, "xn--a.example")
+	// A label starting with a combining mark.
+	testNormalizeServerNameFails(t, "́a.example")
+	// Characters that are disallowed in domain names.
+	testNormalizeServerNameFails(t, "møller☃\u0000.example")
+}
+
+func testUnicodeServerName(t *testing.T, serverName, want string) {
+	if got := unicodeServerName(serverName); got != want {
+		t.Errorf("unicodeServerName(%q): want %q got %q", serverName, want, got)
+	}
+}
+
+func TestUnicodeServerName(t *testing.T) {
+	testUnicodeServerName(t, "xn--mller-vua.example", "møller.example")
+	testUnicodeServerName(t, "matrix.xn--mller-vua.example:8448", "matrix.møller.example:8448")
+	testUnicodeServerName(t, "matrix.org", "")
+	testUnicodeServerName(t, "[::1]:8448", "")
+}
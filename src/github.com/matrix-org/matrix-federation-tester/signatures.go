@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/golang-matrixfederation"
+	"golang.org/x/crypto/ed25519"
+	"strings"
+)
+
+// A SignatureCheck is the result of checking a self-signature on a server key document.
+type SignatureCheck struct {
+	Algorithm    string // The algorithm of the key, e.g. "ed25519".
+	HasVerifyKey bool   // Is there a key with this key ID in "verify_keys"?
+	HasSignature bool   // Is there a signature with this key ID in "signatures"?
+	Verified     bool   // Did the signature verify using the key?
+	Error        error  // Why the signature didn't verify.
+}
+
+// checkSignatures checks the self-signatures on a server key document for
+// every key ID that has either a verify key or a signature.
+// This reports stale signatures left over from a key rotation as well as
+// verify keys that haven't been used to sign the document.
+func checkSignatures(keys matrixfederation.ServerKeys) map[string]SignatureCheck {
+	signatures := keySignatures(keys)
+	results := map[string]SignatureCheck{}
+	for keyID, keyData := range keys.VerifyKeys {
+		_, hasSignature := signatures[keyID]
+		results[keyID] = checkSignature(keys, keyID, keyData.Key, hasSignature)
+	}
+	for keyID := range signatures {
+		if _, ok := results[keyID]; ok {
+			continue
+		}
+		check := SignatureCheck{
+			Algorithm:    keyAlgorithm(keyID),
+			HasSignature: true,
+			Error:        fmt.Errorf("No verify key for signature with ID %q", keyID),
+		}
+		if _, ok := keys.OldVerifyKeys[keyID]; ok {
+			check.Error = fmt.Errorf("Signature with ID %q is from a key in \"old_verify_keys\"", keyID)
+		}
+		results[keyID] = check
+	}
+	return results
+}
+
+// keySignatures returns the server's own signatures on a server key document by key ID.
+func keySignatures(keys matrixfederation.ServerKeys) map[string]json.RawMessage {
+	var content struct {
+		Signatures map[string]map[string]json.RawMessage `json:"signatures"`
+	}
+	// Any problems with the JSON will have already been caught when parsing the keys.
+	json.Unmarshal(keys.Raw, &content)
+	return content.Signatures[keys.ServerName]
+}
+
+// checkSignature checks the signature for a key ID in "verify_keys".
+func checkSignature(keys matrixfederation.ServerKeys, keyID string, publicKey []byte, hasSignature bool) SignatureCheck {
+	check := SignatureCheck{
+		Algorithm:    keyAlgorithm(keyID),
+		HasVerifyKey: true,
+		HasSignature: hasSignature,
+	}
+	if check.Algorithm != "ed25519" {
+		check.Error = fmt.Errorf("Unsupported key algorithm %q", check.Algorithm)
+		return check
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		check.Error = fmt.Errorf("Invalid ed25519 key length %d", len(publicKey))
+		return check
+	}
+	check.Error = matrixfederation.VerifyJSON(keys.ServerName, keyID, publicKey, keys.Raw)
+	check.Verified = check.Error == nil
+	return check
+}
+
+// keyAlgorithm returns the algorithm part of a "<algorithm>:<version>" key ID.
+func keyAlgorithm(keyID string) string {
+	return strings.SplitN(keyID, ":", 2)[0]
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"time"
+)
+
+// sniRequired reports whether the server at addr needs SNI to serve the
+// certificate it served in connState. It does a second handshake without SNI
+// and returns true if that handshake fails or serves a different leaf certificate.
+// Returns nil if there is no time left for the handshake or it timed out, since a
+// slow server doesn't mean the SNI is required.
+func sniRequired(ctx context.Context, addr string, connState *tls.ConnectionState, timeout time.Duration) *bool {
+	if timeout <= 0 {
+		return nil
+	}
+	start := time.Now()
+	tlsconn, _, err := dialTLS(ctx, addr, "", start, start.Add(timeout))
+	if isTimeout(err) {
+		return nil
+	}
+	required := err != nil
+	if err == nil {
+		required = !sameLeaf(connState, tlsconn.ConnectionState())
+		tlsconn.Close()
+	}
+	return &required
+}
+
+// sameLeaf reports whether both TLS connections were served the same leaf certificate.
+func sameLeaf(a *tls.ConnectionState, b tls.ConnectionState) bool {
+	if len(a.PeerCertificates) == 0 || len(b.PeerCertificates) == 0 {
+		return len(a.PeerCertificates) == len(b.PeerCertificates)
+	}
+	return bytes.Equal(a.PeerCertificates[0].Raw, b.PeerCertificates[0].Raw)
+}
+
+// An SNIResult is what a server address served for one of the TLS SNIs when tls_sni lists several.
+type SNIResult struct {
+	Certificates   []X509CertSummary // Summary information for each certificate served for this SNI.
+	CoversSNI      bool              // The subject alternative names of the leaf certificate include this SNI.
+	SameAsFirstSNI bool              // The leaf certificate is the one served for the first SNI listed, which the rest of the report is for.
+	Error          error             // Why the handshake with this SNI failed.
+}
+
+// probeSNIs handshakes with a server address once for each of the extra SNIs, so that
+// proxies that serve a different certificate for each SNI can be checked in one report.
+// The result for the first SNI is taken from the certificates of the full probe of the address.
+// The results are keyed by SNI.
+func probeSNIs(ctx context.Context, addr, firstSNI string, firstCerts []X509CertSummary, extraSNIs []string, now time.Time, timeout time.Duration) map[string]SNIResult {
+	results := map[string]SNIResult{firstSNI: sniResult(firstSNI, firstCerts, firstCerts)}
+	for _, sni := range extraSNIs {
+		start := time.Now()
+		tlsconn, _, err := dialTLS(ctx, addr, sni, start, start.Add(timeout))
+		if err != nil {
+			results[sni] = SNIResult{Error: err}
+			continue
+		}
+		var certs []X509CertSummary
+		for i, cert := range tlsconn.ConnectionState().PeerCertificates {
+			summary := summarizeCertificate(cert, now)
+			summary.ChainIndex = i
+			certs = append(certs, summary)
+		}
+		tlsconn.Close()
+		results[sni] = sniResult(sni, certs, firstCerts)
+	}
+	return results
+}
+
+// sniResult summarizes the certificates served for an SNI, comparing the leaf with the one served for the first SNI.
+func sniResult(sni string, certs, firstCerts []X509CertSummary) SNIResult {
+	result := SNIResult{Certificates: certs}
+	if len(certs) > 0 {
+		result.CoversSNI, _ = certCoversName(certs[0], sni)
+		result.SameAsFirstSNI = len(firstCerts) > 0 && bytes.Equal(certs[0].SHA256Fingerprint, firstCerts[0].SHA256Fingerprint)
+	}
+	return result
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+)
+
+// The rules checked for StrictFederationOK, which are the rules a modern homeserver
+// applies when it connects to another server, as opposed to the lenient key checks
+// the tester has always used for FederationOK.
+// These are part of the API so they mustn't be changed once added.
+const (
+	strictTrustedChain     = "trusted_chain"      // The certificate chain verified against the trusted roots.
+	strictCoversServerName = "covers_server_name" // The leaf certificate covers the TLS SNI sent.
+	strictTLSVersion       = "tls_version"        // The connection negotiated TLS 1.2 or later.
+	strictSignedKeys       = "signed_keys"        // The keys are for the server name and are signed by every ed25519 key.
+	strictNotExpired       = "not_expired"        // Neither the keys nor any certificate in the chain have expired.
+)
+
+// strictFailures returns the strict rules that a connection failed, in the order they are listed above.
+// Unlike FailedChecks, skip_checks doesn't apply and the TLS fingerprints aren't checked since
+// modern homeservers ignore them. A chain that wasn't verified because SKIP_CHAIN_VERIFICATION
+// is set counts as failing, since a strict server would verify it.
+func strictFailures(connReport ConnectionReport, version uint16) []string {
+	var failed []string
+	if !isTrue(connReport.ChainVerified) {
+		failed = append(failed, strictTrustedChain)
+	}
+	if !connReport.CoversServerName {
+		failed = append(failed, strictCoversServerName)
+	}
+	if version < tls.VersionTLS12 {
+		failed = append(failed, strictTLSVersion)
+	}
+	if !verdictChecks["server_name"](connReport.Checks) || !verdictChecks["ed25519"](connReport.Checks) {
+		failed = append(failed, strictSignedKeys)
+	}
+	if !connReport.Checks.FutureValidUntilTS || anyCertExpired(connReport.Certificates) {
+		failed = append(failed, strictNotExpired)
+	}
+	return failed
+}
+
+// anyCertExpired returns true if any of the certificates has expired.
+func anyCertExpired(certs []X509CertSummary) bool {
+	for _, cert := range certs {
+		if cert.Expired {
+			return true
+		}
+	}
+	return false
+}
+
+// computeStrictVerdict sets StrictFederationOK, which is true if at least one address
+// connected and every address that connected passed all of the strict rules.
+func (report *ServerReport) computeStrictVerdict() {
+	report.StrictFederationOK = len(report.ConnectionReports) > 0
+	for _, connReport := range report.ConnectionReports {
+		if len(connReport.StrictFailures) > 0 {
+			report.StrictFederationOK = false
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// renderText writes a line oriented plain text summary of a touched up report.
+// Each line is a "<name>: <value>" pair, and lines about a server address
+// start with the address so that they can be grepped for.
+func renderText(w io.Writer, serverName string, report *ServerReport) {
+	fmt.Fprintf(w, "ServerName: %s\n", serverName)
+	fmt.Fprintf(w, "FederationOK: %v\n", report.FederationOK)
+	fmt.Fprintf(w, "Summary: %s\n", report.Summary)
+	if wellKnown := report.WellKnownResult; wellKnown != nil {
+		if wellKnown.ServerAddress != "" {
+			fmt.Fprintf(w, "WellKnown: %s\n", wellKnown.ServerAddress)
+		} else {
+			fmt.Fprintf(w, "WellKnown: none (%v)\n", wellKnown.Error)
+		}
+	}
+	if len(report.CNAMEChain) > 0 {
+		fmt.Fprintf(w, "CNAME: %s\n", strings.Join(report.CNAMEChain, " -> "))
+	}
+	for _, record := range report.DNSResult.SRVRecords {
+		fmt.Fprintf(w, "SRV: %s:%d priority=%d weight=%d\n", record.Target, record.Port, record.Priority, record.Weight)
+	}
+	if report.UsedDefaultPort {
+		fmt.Fprintf(w, "SRV: none, using port %s\n", defaultFederationPort)
+	}
+	for _, addr := range reportAddrs(report) {
+		if err, ok := report.ConnectionErrors[addr]; ok {
+			fmt.Fprintf(w, "%s Connection: ERROR %v\n", addr, err)
+			continue
+		}
+		renderConnectionText(w, addr, report.ConnectionReports[addr])
+	}
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(w, "Warning: %s\n", warning.Message)
+	}
+}
+
+// renderConnectionText writes the plain text lines for a server address we connected to.
+func renderConnectionText(w io.Writer, addr string, connReport ConnectionReport) {
+	fmt.Fprintf(w, "%s Connection: OK\n", addr)
+	fmt.Fprintf(w, "%s TLS: %s %s (%s)\n", addr, connReport.Cipher.Version, connReport.Cipher.CipherSuite, connReport.Cipher.Grade)
+	for _, cert := range connReport.Certificates {
+		fmt.Fprintf(
+			w, "%s Certificate[%d]: CN=%s expires %s (%d days)\n",
+			addr, cert.ChainIndex, cert.SubjectCommonName, cert.NotAfter.UTC().Format("2006-01-02T15:04:05Z"), cert.DaysUntilExpiry,
+		)
+	}
+	if connReport.Checks.AllChecksOK {
+		fmt.Fprintf(w, "%s Keys: all checks OK\n", addr)
+	} else {
+		var failed []string
+		for name, ok := range connReport.ChecksSummary {
+			if !ok && name != checkAllChecksOK {
+				failed = append(failed, name)
+			}
+		}
+		sort.Strings(failed)
+		fmt.Fprintf(w, "%s Keys: FAILED %v\n", addr, failed)
+	}
+	if connReport.Version.Error != nil {
+		fmt.Fprintf(w, "%s Version: ERROR %v\n", addr, connReport.Version.Error)
+	} else {
+		fmt.Fprintf(w, "%s Version: %s %s\n", addr, connReport.Version.Name, connReport.Version.Version)
+	}
+}
+
+// reportAddrs returns the sorted addresses that the report has either a connection report or error for.
+func reportAddrs(report *ServerReport) []string {
+	addrs := sortedAddrs(report.ConnectionReports)
+	for addr := range report.ConnectionErrors {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// encodeReportText renders a touched up report as plain text.
+func encodeReportText(serverName string, report *ServerReport) []byte {
+	var buffer bytes.Buffer
+	renderText(&buffer, serverName, report)
+	return buffer.Bytes()
+}
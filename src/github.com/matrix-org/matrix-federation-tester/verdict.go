@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The values of Verdict, so that alerts can be routed by what went wrong.
+// These are part of the API so they mustn't be changed once added.
+const (
+	verdictOK              = "ok"                // Federation is OK.
+	verdictNoAddresses     = "no_addresses"      // The server didn't resolve to any addresses, so it's a DNS problem.
+	verdictNoConnections   = "no_connections"    // The server resolved but none of its addresses connected and returned keys.
+	verdictKeyChecksFailed = "key_checks_failed" // At least one address connected but the keys it returned failed the checks.
+)
+
+// computeVerdict sets FederationOK, Verdict, Resolved, AnyConnected and Summary from the rest of the report.
+// Federation is OK if at least one address connected and every address that
+// connected passed all of the key checks, other than the SkippedChecks.
+// Also sets the FailedChecks of each connection report.
+func (report *ServerReport) computeVerdict() {
+	report.FederationOK = false
+	addrCount := len(report.DNSResult.Addrs)
+	report.Resolved = addrCount > 0
+	report.AnyConnected = len(report.ConnectionReports) > 0
+	if !report.Resolved {
+		report.Verdict = verdictNoAddresses
+		report.Summary = "No addresses were found for the server in DNS"
+		return
+	}
+	if !report.AnyConnected {
+		report.Verdict = verdictNoConnections
+		report.Summary = fmt.Sprintf("Could not connect to any of the %d server addresses", addrCount)
+		return
+	}
+	var failed []string
+	for addr, connReport := range report.ConnectionReports {
+		connReport.FailedChecks = failedChecks(connReport.Checks, report.SkippedChecks)
+		report.ConnectionReports[addr] = connReport
+		if len(connReport.FailedChecks) > 0 {
+			failed = append(failed, addr)
+		}
+	}
+	if len(failed) > 0 {
+		report.Verdict = verdictKeyChecksFailed
+		sort.Strings(failed)
+		report.Summary = fmt.Sprintf("The key checks failed for %v", failed)
+		return
+	}
+	report.FederationOK = true
+	report.Verdict = verdictOK
+	report.Summary = fmt.Sprintf(
+		"%d of %d server addresses connected and passed all the key checks",
+		len(report.ConnectionReports), addrCount,
+	)
+}
+
+// HandleVerdict handles an HTTP request for just the verdict on a matrix server as
+// plain text, so that shell scripts can check a server without parsing JSON.
+// GET /api/verdict?server_name=matrix.org&tls_sni=whatever&timeout=10&no_cache=1 request.
+// Takes the same query parameters as /api/report, other than format which is ignored.
+// Responds with "OK" and a 200 if FederationOK is set, or "FAIL" and a 503 if it isn't,
+// so that curl --fail exits with an error too. Other errors are a line saying what went wrong.
+func HandleVerdict(w http.ResponseWriter, req *http.Request) {
+	setCORSHeaders(w, "GET")
+	if req.Method == "OPTIONS" {
+		return
+	}
+	rlog := newRequestLog()
+	defer rlog.write()
+	w.Header().Set("X-Request-ID", rlog.ID)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if req.Method != "GET" {
+		rlog.Outcome = "unsupported method"
+		writeVerdictError(w, 405, fmt.Errorf("Unsupported method %q", req.Method))
+		return
+	}
+	request, err := parseFormatlessReportRequest(req)
+	if err != nil {
+		rlog.Outcome = "bad request: " + err.Error()
+		writeVerdictError(w, 400, err)
+		return
+	}
+	rlog.ServerName, rlog.TLSSNI = request.ServerName, request.TLSSNI
+	report, err := cachedReport(req.Context(), *request)
+	if err == errReportCancelled {
+		rlog.Outcome = "cancelled"
+		return
+	}
+	if err != nil {
+		rlog.Outcome = "error: " + err.Error()
+		writeVerdictError(w, reportErrorStatus(w, err, 500), err)
+		return
+	}
+	rlog.Addrs = report.DNSResult.Addrs
+	rlog.Outcome = report.Summary
+	setCacheHeaders(w, report, time.Now())
+	if !report.FederationOK {
+		w.WriteHeader(503)
+		fmt.Fprintln(w, "FAIL")
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprintln(w, "OK")
+}
+
+// writeVerdictError writes an error from /api/verdict as a line of plain text.
+func writeVerdictError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "ERROR: %v\n", err)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/ed25519"
+	"regexp"
+)
+
+// A VerifyKey is a key from the "verify_keys" of a server key document.
+// https://matrix.org/docs/spec/server_server/r0.1.0.html#get-matrix-key-v2-server-keyid
+type VerifyKey struct {
+	Algorithm string // The algorithm of the key, e.g. "ed25519".
+	Key       string // The public key as advertised, which should be unpadded base64.
+	Valid     bool   // Is the key ID well-formed and the key a valid key for its algorithm?
+	Signed    bool   // Is the document signed by this key with a signature that verifies?
+	Error     error  // Why the key isn't valid.
+}
+
+// keyIDPattern matches a well-formed "<algorithm>:<version>" key ID.
+var keyIDPattern = regexp.MustCompile(`^[a-z0-9._-]+:[a-zA-Z0-9_]+$`)
+
+// summarizeVerifyKeys returns every key in the "verify_keys" of a server key document by key ID.
+// The keys are parsed from the raw JSON rather than from matrixfederation.ServerKeys
+// so that they are reported exactly as they were advertised.
+// The signatures are the results of checkSignatures for the document.
+func summarizeVerifyKeys(raw []byte, signatures map[string]SignatureCheck) map[string]VerifyKey {
+	var content struct {
+		VerifyKeys map[string]struct {
+			Key string `json:"key"`
+		} `json:"verify_keys"`
+	}
+	// Any problems with the JSON will have already been caught when parsing the keys.
+	json.Unmarshal(raw, &content)
+	results := map[string]VerifyKey{}
+	for keyID, keyData := range content.VerifyKeys {
+		key := VerifyKey{
+			Algorithm: keyAlgorithm(keyID),
+			Key:       keyData.Key,
+			Signed:    signatures[keyID].Verified,
+		}
+		key.Error = validateVerifyKey(keyID, key.Algorithm, keyData.Key)
+		key.Valid = key.Error == nil
+		results[keyID] = key
+	}
+	return results
+}
+
+// validateVerifyKey checks that a key ID is well-formed and that the key is valid for its algorithm.
+func validateVerifyKey(keyID, algorithm, key string) error {
+	if !keyIDPattern.MatchString(keyID) {
+		return fmt.Errorf("Invalid key ID %q, expected \"<algorithm>:<version>\"", keyID)
+	}
+	if algorithm != "ed25519" {
+		return fmt.Errorf("Unsupported key algorithm %q", algorithm)
+	}
+	// Matrix uses unpadded base64.
+	decoded, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("Invalid base64 for key %q: %v", keyID, err)
+	}
+	if len(decoded) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid ed25519 key length %d", len(decoded))
+	}
+	return nil
+}
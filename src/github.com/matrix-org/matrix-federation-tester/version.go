@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A VersionReport is the server implementation advertised by a matrix server.
+// https://matrix.org/docs/spec/server_server/r0.1.0.html#get-matrix-federation-v1-version
+type VersionReport struct {
+	Name                 string // The name of the server implementation, e.g. "Synapse".
+	Version              string // The version of the server implementation.
+	Error                error  // If there was an error fetching the version.
+	TimedOut             bool   // The Error is because there was no time left to fetch the version, so it doesn't count against the score.
+	SupportsFederationV2 *bool  // The server recognises the v2 federation API, or nil if it couldn't be told, see probeFederationV2.
+	Outdated             bool   // The Version is older than the MinimumVersion for the implementation.
+	MinimumVersion       string // The oldest version of the implementation that can federate, or empty if it isn't known, see minimumVersions.
+}
+
+// minimumVersions are the oldest versions of the known server implementations
+// that can federate with current servers, by the name they advertise.
+// Synapse 1.0.0 was the first release to implement the r0.1.0 server-server
+// API, requiring valid certificates and the v2 key and invite endpoints.
+var minimumVersions = map[string]string{
+	"Synapse": "1.0.0",
+}
+
+// federationV2ProbePath is an endpoint of the v2 federation API, which replaced the v1
+// send_join, send_leave and invite endpoints. The room and event IDs don't exist.
+const federationV2ProbePath = "/_matrix/federation/v2/send_join/%21probe%3Aexample.com/%24probe"
+
+// probeFederationV2 checks whether a server address recognises the v2 federation API.
+// The request is unauthenticated and uses GET rather than PUT so that it can't change
+// anything. Servers that recognise the endpoint reject it with 401, 403 or 405, while
+// servers that don't, or reverse proxies that don't route it, return 404 or a 400 with
+// the M_UNRECOGNIZED error code. Other 400s don't tell since proxies commonly answer
+// unknown paths with them.
+// Returns nil if the server couldn't be asked or its response doesn't tell.
+func probeFederationV2(ctx context.Context, serverName, addr, sni string, timeout time.Duration) *bool {
+	response, err := getDirect(ctx, serverName, addr, sni, federationV2ProbePath, timeout)
+	if err != nil {
+		return nil
+	}
+	var supported bool
+	switch response.StatusCode {
+	case 401, 403, 405:
+		supported = true
+	case 404:
+		supported = false
+	case 400:
+		var content struct {
+			Errcode string `json:"errcode"`
+		}
+		if json.Unmarshal(response.Body, &content) != nil || content.Errcode != "M_UNRECOGNIZED" {
+			return nil
+		}
+		supported = false
+	default:
+		return nil
+	}
+	return &supported
+}
+
+// checkMinimumVersion sets the MinimumVersion and Outdated fields of a version
+// report for a known implementation.
+func (result *VersionReport) checkMinimumVersion() {
+	minimum, ok := minimumVersions[result.Name]
+	if !ok || result.Error != nil {
+		return
+	}
+	result.MinimumVersion = minimum
+	result.Outdated = compareVersions(result.Version, minimum) < 0
+}
+
+// compareVersions compares the leading dotted numbers of two version strings,
+// e.g. "1.98.0 (b=matrix-org-hotfixes)", returning -1, 0 or 1.
+// Missing or non-numeric components count as 0.
+func compareVersions(a, b string) int {
+	aParts, bParts := versionNumbers(a), versionNumbers(b)
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart int
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+		if aPart != bPart {
+			if aPart < bPart {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionNumbers returns the numbers in the leading dotted part of a version string.
+func versionNumbers(version string) []int {
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(version), "v"))
+	if len(fields) == 0 {
+		return nil
+	}
+	var numbers []int
+	for _, part := range strings.Split(fields[0], ".") {
+		end := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+		if end >= 0 {
+			part = part[:end]
+		}
+		number, _ := strconv.Atoi(part)
+		numbers = append(numbers, number)
+	}
+	return numbers
+}
+
+// versionWarnings returns the warnings about the server implementation at a server address.
+func versionWarnings(addr string, version VersionReport) []ReportWarning {
+	var warnings []ReportWarning
+	if version.Outdated {
+		warnings = append(warnings, warningf(
+			warnOutdatedVersion, addr, "%s runs %s %s, versions before %s can't federate with current servers and should be upgraded", addr, version.Name, version.Version, version.MinimumVersion,
+		))
+	}
+	if version.SupportsFederationV2 != nil && !*version.SupportsFederationV2 {
+		warnings = append(warnings, warningf(
+			warnNoFederationV2, addr, "%s doesn't recognise the v2 federation API, so it only supports the deprecated v1 endpoints for joining rooms and invites. Upgrade the server or check that the reverse proxy forwards all of /_matrix/federation", addr,
+		))
+	}
+	return warnings
+}
+
+// fetchVersionDirect fetches the server version directly from the given address.
+// Errors are recorded in the VersionReport rather than returned since the
+// version endpoint is informational. The fetch shares the timeout with the
+// rest of the probe of the address, so the version may be left unknown if an
+// earlier request used up the time, in which case TimedOut is set.
+func fetchVersionDirect(ctx context.Context, serverName, addr, sni string, timeout time.Duration) VersionReport {
+	var result VersionReport
+	response, err := getDirect(ctx, serverName, addr, sni, "/_matrix/federation/v1/version", timeout)
+	if err != nil {
+		result.Error = err
+		result.TimedOut = isTimeout(err)
+		return result
+	}
+	if response.StatusCode != 200 {
+		result.Error = fmt.Errorf("GET /_matrix/federation/v1/version returned %q", response.Status)
+		return result
+	}
+	var content struct {
+		Server struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"server"`
+	}
+	if err = json.Unmarshal(response.Body, &content); err != nil {
+		result.Error = err
+		return result
+	}
+	result.Name = content.Server.Name
+	result.Version = content.Server.Version
+	return result
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// keyExpiryWarningPeriod is how long before the keys expire that we warn about it.
+const keyExpiryWarningPeriod = 24 * time.Hour
+
+// minPlausibleKeyValidity is the shortest time until valid_until_ts that we expect
+// from a server with a correct clock. Servers publish keys that are valid for
+// hours or days and refresh them well before they expire, so keys that are
+// already expired or about to expire usually mean the server's clock is wrong,
+// or that it computes valid_until_ts wrongly.
+const minPlausibleKeyValidity = time.Hour
+
+// A ReportWarning is a problem that doesn't stop federation working now but is
+// likely to break it, as opposed to the ConnectionErrors that do stop it working.
+type ReportWarning struct {
+	Code    string // A stable code for the kind of problem that programs can branch on, see below.
+	Address string `json:",omitempty"` // The server address the problem was found on, if it was found on one.
+	Message string // Human readable description of the problem and how to fix it.
+}
+
+// The codes of ReportWarnings. These are part of the API so they mustn't be changed once added.
+const (
+	warnKeyFetchRedirect  = "KEY_FETCH_REDIRECT"
+	warnStrictRules       = "STRICT_RULES_FAILED"
+	warnSRVTargetCNAME    = "SRV_TARGET_CNAME"
+	warnInconsistent      = "INCONSISTENT_BACKENDS"
+	warnCertOriginalName  = "CERT_FOR_ORIGINAL_NAME"
+	warnCertSelfSigned    = "CERT_SELF_SIGNED"
+	warnCertExpired       = "CERT_EXPIRED"
+	warnCertExpiring      = "CERT_EXPIRING"
+	warnCertRevoked       = "CERT_REVOKED"
+	warnIncompleteChain   = "INCOMPLETE_CHAIN"
+	warnCertNameMismatch  = "CERT_NAME_MISMATCH"
+	warnWeakRSAKey        = "WEAK_RSA_KEY"
+	warnSHA1Signature     = "SHA1_SIGNATURE"
+	warnKeyContentType    = "KEY_CONTENT_TYPE"
+	warnClientCertRequest = "CLIENT_CERT_REQUESTED"
+	warnUnexpectedALPN    = "UNEXPECTED_ALPN"
+	warnWeakCipher        = "WEAK_CIPHER"
+	warnKeysExpired       = "KEYS_EXPIRED"
+	warnClockSkew         = "CLOCK_SKEW"
+	warnKeysExpiring      = "KEYS_EXPIRING"
+	warnOutdatedVersion   = "OUTDATED_VERSION"
+	warnNoFederationV2    = "NO_FEDERATION_V2"
+)
+
+// warningf returns a ReportWarning with the given code for a server address, or for the
+// whole server if addr is empty, with the message formatted according to the format specifier.
+func warningf(code, addr, format string, args ...interface{}) ReportWarning {
+	return ReportWarning{Code: code, Address: addr, Message: fmt.Sprintf(format, args...)}
+}
+
+// collectWarnings adds warnings to the report for problems with the
+// connections that won't stop federation working now but are likely to,
+// and for connection errors that are easy to misread.
+func (report *ServerReport) collectWarnings() {
+	for _, addr := range sortedErrorAddrs(report.ConnectionErrors) {
+		if errorCode(report.ConnectionErrors[addr]) == codeKeyFetchRedirect {
+			report.Warnings = append(report.Warnings, warningf(
+				warnKeyFetchRedirect, addr, "The key endpoint on %s is redirecting, which breaks federation since servers don't follow redirects when fetching keys. Check the reverse proxy configuration for /_matrix", addr,
+			))
+		}
+	}
+	if report.FederationOK && !report.StrictFederationOK {
+		report.Warnings = append(report.Warnings, warningf(
+			warnStrictRules, "", "Federation works under the key checks but some addresses fail the strict rules that modern homeservers apply, see StrictFailures",
+		))
+	}
+	for _, target := range sortedTargets(report.SRVTargetCNAMEs) {
+		chain := report.SRVTargetCNAMEs[target]
+		report.Warnings = append(report.Warnings, warningf(
+			warnSRVTargetCNAME, "", "The SRV record target %s is a CNAME for %s, RFC 2782 requires SRV targets to have their own A or AAAA records and some homeservers can't follow the CNAME", target, chain[len(chain)-1],
+		))
+	}
+	for _, difference := range report.BackendDifferences {
+		report.Warnings = append(report.Warnings, warningf(
+			warnInconsistent, "", "The addresses of the server returned %d different %s, it may be behind a load balancer with inconsistent backends so federation only works some of the time", len(difference.Values), difference.Field,
+		))
+	}
+	for _, addr := range sortedAddrs(report.ConnectionReports) {
+		connReport := report.ConnectionReports[addr]
+		if coversOnlyOriginalName(connReport) {
+			report.Warnings = append(report.Warnings, warningf(
+				warnCertOriginalName, addr, "The certificate served by %s is valid for %s but not for %s, the server is delegated to %s using .well-known so its certificate must be valid for %s", addr, hostOf(report.ServerName), report.ConnectionHost, report.ConnectionHost, report.ConnectionHost,
+			))
+		}
+		warnings := connectionWarnings(addr, connReport, report.CheckedAt)
+		report.Warnings = append(report.Warnings, warnings...)
+	}
+}
+
+// coversOnlyOriginalName returns true if the server was delegated to another host using
+// .well-known but the certificate was issued for the original server name instead,
+// which is a common mistake since it's the server name that is in user IDs.
+func coversOnlyOriginalName(connReport ConnectionReport) bool {
+	return !connReport.CoversServerName && connReport.CoversOriginalName != nil && *connReport.CoversOriginalName
+}
+
+// connectionWarnings returns the warnings for the connection to a single server address.
+func connectionWarnings(addr string, connReport ConnectionReport, now time.Time) []ReportWarning {
+	var warnings []ReportWarning
+	if len(connReport.Certificates) > 0 && connReport.Certificates[0].SelfSigned {
+		warnings = append(warnings, warningf(
+			warnCertSelfSigned, addr, "The certificate served by %s is self-signed, servers that validate certificates will refuse to federate with it", addr,
+		))
+	}
+	for _, cert := range connReport.Certificates {
+		if cert.DaysUntilExpiry < certExpiryWarningDays {
+			warnings = append(warnings, certExpiryWarning(addr, cert))
+		}
+	}
+	if connReport.OCSPStatus == ocspRevoked {
+		warnings = append(warnings, warningf(
+			warnCertRevoked, addr, "The OCSP response stapled by %s says its certificate has been revoked, replace the certificate", addr,
+		))
+	}
+	if connReport.IncompleteChain {
+		warnings = append(warnings, warningf(
+			warnIncompleteChain, addr, "%s only sent %d certificate(s) without the intermediate certificates needed to build a chain to a trusted root, browsers may fetch them but matrix servers won't", addr, len(connReport.Certificates),
+		))
+	}
+	if len(connReport.Certificates) > 0 && !connReport.CoversServerName && !coversOnlyOriginalName(connReport) {
+		leaf := connReport.Certificates[0]
+		names := append(append([]string{}, leaf.DNSNames...), leaf.IPAddresses...)
+		warnings = append(warnings, warningf(
+			warnCertNameMismatch, addr, "The certificate served by %s doesn't list the server name in its subject alternative names %v, servers that validate certificates will refuse to federate with it", addr, names,
+		))
+	}
+	if len(connReport.Certificates) > 0 && isWeakRSAKey(connReport.Certificates[0]) {
+		warnings = append(warnings, warningf(
+			warnWeakRSAKey, addr, "The certificate served by %s has a %d bit RSA key, keys under %d bits are considered weak and should be replaced", addr, connReport.Certificates[0].PublicKeyBits, minRSAKeyBits,
+		))
+	}
+	if len(connReport.Certificates) > 0 && isSHA1Signature(connReport.Certificates[0]) {
+		warnings = append(warnings, warningf(
+			warnSHA1Signature, addr, "The certificate served by %s is signed using the deprecated SHA-1 algorithm %s, many TLS clients will refuse it", addr, connReport.Certificates[0].SignatureAlgorithm,
+		))
+	}
+	if connReport.Keys != nil && !connReport.KeyContentTypeOK {
+		warnings = append(warnings, warningf(
+			warnKeyContentType, addr, "The key response from %s has the Content-Type %q rather than \"application/json\", check that a proxy isn't rewriting it", addr, connReport.KeyContentType,
+		))
+	}
+	if connReport.ClientCertRequested {
+		warnings = append(warnings, warningf(
+			warnClientCertRequest, addr, "%s asks for a client certificate during the TLS handshake, it accepted the connection without one but check that the reverse proxy isn't configured to verify client certificates", addr,
+		))
+	}
+	if protocol := connReport.NegotiatedProtocol; protocol != "" && protocol != "http/1.1" {
+		warnings = append(warnings, warningf(
+			warnUnexpectedALPN, addr, "%s negotiated the unexpected ALPN protocol %q, the federation API is served over HTTP/1.1", addr, protocol,
+		))
+	}
+	if isWeakGrade(connReport.Cipher.Grade) {
+		warnings = append(warnings, warningf(
+			warnWeakCipher, addr, "%s negotiated the %s cipher suite %s, it should be disabled in favour of a modern suite", addr, connReport.Cipher.Grade, connReport.Cipher.CipherSuite,
+		))
+	}
+	if connReport.KeyExpired {
+		warnings = append(warnings, warningf(
+			warnKeysExpired, addr, "The keys served by %s expired at %s, other servers will refuse to use them. Check that the server's clock is correct", addr, connReport.KeyValidUntil.UTC().Format(time.RFC3339),
+		))
+	} else if remaining := connReport.KeyValidUntil.Sub(now); connReport.ClockSkewSuspected {
+		warnings = append(warnings, warningf(
+			warnClockSkew, addr, "The keys served by %s are only valid for %v, check that the server's clock is correct", addr, remaining.Round(time.Second),
+		))
+	} else if remaining < keyExpiryWarningPeriod {
+		warnings = append(warnings, warningf(
+			warnKeysExpiring, addr, "The keys served by %s expire in %v, check that the server is refreshing its valid_until_ts", addr, remaining.Round(time.Minute),
+		))
+	}
+	return append(warnings, versionWarnings(addr, connReport.Version)...)
+}
+
+// certExpiryWarning returns the warning for a certificate in the chain served by a server address
+// that has expired or expires within certExpiryWarningDays.
+func certExpiryWarning(addr string, cert X509CertSummary) ReportWarning {
+	which := "leaf certificate"
+	if cert.ChainIndex > 0 {
+		which = fmt.Sprintf("certificate %d in the chain", cert.ChainIndex)
+	}
+	if cert.Expired {
+		return warningf(
+			warnCertExpired, addr, "The %s served by %s (CN=%s) expired at %s, renew it or update the chain the server is configured with", which, addr, cert.SubjectCommonName, cert.NotAfter.UTC().Format(time.RFC3339),
+		)
+	}
+	return warningf(
+		warnCertExpiring, addr, "The %s served by %s (CN=%s) expires in %d days at %s, renew it or update the chain the server is configured with", which, addr, cert.SubjectCommonName, cert.DaysUntilExpiry, cert.NotAfter.UTC().Format(time.RFC3339),
+	)
+}
+
+// sortedErrorAddrs returns the addresses in a map of connection errors in sorted order.
+func sortedErrorAddrs(errs map[string]error) []string {
+	var addrs []string
+	for addr := range errs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// sortedAddrs returns the addresses in a map of connection reports in sorted order.
+func sortedAddrs(connReports map[string]ConnectionReport) []string {
+	var addrs []string
+	for addr := range connReports {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// sortedTargets returns the targets in a map of SRV target CNAME chains in sorted order.
+func sortedTargets(chains map[string][]string) []string {
+	var targets []string
+	for target := range chains {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The maximum number of bytes of a .well-known response that we will read.
+const maxWellKnownBytes = 64 * 1024
+
+// The maximum number of HTTP redirects followed when fetching a .well-known file.
+const maxWellKnownRedirects = 5
+
+// wellKnownClient is the HTTP client used to fetch .well-known files.
+// Its Timeout is only a backstop since lookupWellKnown bounds each lookup by the report's timeout.
+// Unlike the key requests the .well-known file must be served with a valid certificate.
+// Its transport refuses to connect to addresses blocked by checkAddress.
+var wellKnownClient = &http.Client{Timeout: 30 * time.Second, Transport: restrictedTransport()}
+
+// A WellKnownResult is the result of looking up a matrix server's delegation in .well-known.
+// https://matrix.org/docs/spec/server_server/r0.1.0.html#resolving-server-names
+type WellKnownResult struct {
+	Raw           *json.RawMessage // The raw JSON served in the .well-known file, if it was valid JSON.
+	ServerAddress string           // The delegated "<host>[:<port>]" from the "m.server" field, or empty if there was no delegation.
+	Redirects     []string         // The URLs we were redirected to, in order, when fetching the .well-known file.
+	Error         error            // If there was an error fetching or parsing the .well-known file.
+}
+
+// lookupWellKnown fetches https://<serverName>/.well-known/matrix/server and parses the delegated server address.
+// The whole lookup, including any redirects, must finish within the timeout, which is the
+// timeout of the report so that a black-holed host can't hold the report for longer.
+func lookupWellKnown(ctx context.Context, serverName string, timeout time.Duration) *WellKnownResult {
+	var result WellKnownResult
+	lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(lookupCtx, "GET", "https://"+serverName+"/.well-known/matrix/server", nil)
+	if err != nil {
+		result.Error = err
+		return &result
+	}
+	request.Header.Set("User-Agent", userAgent)
+	// Copy the client so that we can record the redirects for this lookup.
+	client := *wellKnownClient
+	client.CheckRedirect = result.checkRedirect
+	response, err := client.Do(request)
+	if err != nil && ctx.Err() == nil && lookupCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("GET .well-known/matrix/server timed out after %v", timeout)
+	}
+	if err != nil {
+		result.Error = err
+		return &result
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		result.Error = fmt.Errorf("GET .well-known/matrix/server returned %q", response.Status)
+		return &result
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxWellKnownBytes))
+	if err != nil {
+		result.Error = err
+		return &result
+	}
+	var content struct {
+		Server string `json:"m.server"`
+	}
+	if err = json.Unmarshal(body, &content); err != nil {
+		result.Error = err
+		return &result
+	}
+	raw := json.RawMessage(body)
+	result.Raw = &raw
+	if err = validateServerAddress(content.Server); err != nil {
+		result.Error = err
+		return &result
+	}
+	result.ServerAddress = content.Server
+	return &result
+}
+
+// checkRedirect records each redirect followed when fetching the .well-known file.
+// It stops after maxWellKnownRedirects, or if a URL redirects back to one we've already fetched.
+func (result *WellKnownResult) checkRedirect(req *http.Request, via []*http.Request) error {
+	target := req.URL.String()
+	result.Redirects = append(result.Redirects, target)
+	for _, previous := range via {
+		if previous.URL.String() == target {
+			return fmt.Errorf("Redirect loop back to %q", target)
+		}
+	}
+	if len(via) > maxWellKnownRedirects {
+		return fmt.Errorf("Stopped after %d redirects", maxWellKnownRedirects)
+	}
+	return nil
+}
+
+// delegatedFrom returns the host of the server name if it was delegated to a different
+// host, which the certificates must be valid for instead, or empty if it wasn't.
+func delegatedFrom(serverName, connectName string) string {
+	if strings.EqualFold(hostOf(serverName), hostOf(connectName)) {
+		return ""
+	}
+	return hostOf(serverName)
+}
+
+// validateServerAddress checks that a delegated server address is a "<host>[:<port>]".
+func validateServerAddress(address string) error {
+	if address == "" {
+		return fmt.Errorf("No \"m.server\" in .well-known/matrix/server")
+	}
+	if strings.ContainsAny(address, "/ \t\r\n") {
+		return fmt.Errorf("Invalid \"m.server\" %q in .well-known/matrix/server", address)
+	}
+	if hasExplicitPort(address) {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("Invalid \"m.server\" %q in .well-known/matrix/server: %v", address, err)
+		}
+	}
+	return nil
+}